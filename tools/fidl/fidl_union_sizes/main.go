@@ -0,0 +1,76 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// The program fidl_union_sizes prints the wire sizes of the unions of a FIDL
+// library, as computed for the generated LLCPP bindings, for capacity
+// planning.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+	cpp "go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen_cpp"
+)
+
+var fir = flag.String("fidl-ir-file", "", "The FIDL IR input file to print the union sizes of.")
+
+// usage prints a user-friendly usage message when the flag --help is provided.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(),
+		`%v prints the inline size, out-of-line bound and handle bound of every
+union in a FIDL intermediate representation file, as a table.
+
+Usage:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// bound formats an out-of-line or handle bound, which saturates at the
+// maximum uint32 when unbounded.
+func bound(n int) string {
+	if n >= math.MaxUint32 {
+		return "unbounded"
+	}
+	return fmt.Sprint(n)
+}
+
+// writeSizes writes a row for each union of |root| to |w|.
+func writeSizes(root cpp.Root, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "UNION\tINLINE SIZE\tMAX OUT-OF-LINE\tMAX HANDLES")
+	for _, decl := range root.Decls {
+		u, ok := decl.(cpp.Union)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n",
+			u.TypeName, u.InlineSize, bound(u.MaxOutOfLine), bound(u.MaxHandles))
+	}
+	return tw.Flush()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *fir == "" {
+		fmt.Fprintf(os.Stderr, "The flag --fidl-ir-file=... is required")
+		os.Exit(1)
+	}
+	ir, err := fidlgen.ReadJSONIr(*fir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v", err)
+		os.Exit(1)
+	}
+	if err := writeSizes(cpp.CompileLL(ir, cpp.HeaderOptions{}), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "While writing the sizes: %v", err)
+		os.Exit(1)
+	}
+}
@@ -31,21 +31,39 @@ func NewFidlGenerator() *FidlGenerator {
 				}
 				return s2
 			},
-			"Protocols":            protocols,
-			"CountDecoderEncoders": countDecoderEncoders,
+			"Protocols":                    protocols,
+			"Unions":                       unions,
+			"UnusedOrdinal":                unusedOrdinal,
+			"UnionTagTables":               unionTagTables,
+			"TaggedUnions":                 taggedUnions,
+			"ExpectedHandleRights":         expectedHandleRights,
+			"CountDecoderEncoders":         countDecoderEncoders,
+			"CountProtocolDecoderEncoders": countProtocolDecoderEncoders,
+			"WalkMembers":                  walkMembers,
+			// Replaced with the configured values by GenerateFidl.
+			"MemberCoverage":         func() bool { return false },
+			"ValidateUnionEnvelopes": func() bool { return false },
+			"SeedInputs":             func() []seedInput { return nil },
+			"PartialDecode":          func() bool { return false },
 		}))
 
 	template.Must(tmpls.Parse(tmplBits))
 	template.Must(tmpls.Parse(tmplDecoderEncoder))
 	template.Must(tmpls.Parse(tmplDecoderEncoderHeader))
+	template.Must(tmpls.Parse(tmplDecoderEncoderMutator))
 	template.Must(tmpls.Parse(tmplDecoderEncoderSource))
+	template.Must(tmpls.Parse(tmplDecodedWalk))
 	template.Must(tmpls.Parse(tmplEnum))
+	template.Must(tmpls.Parse(tmplHandleRights))
 	template.Must(tmpls.Parse(tmplHeader))
+	template.Must(tmpls.Parse(tmplPartialDecode))
 	template.Must(tmpls.Parse(tmplProtocolDecoderEncoders))
+	template.Must(tmpls.Parse(tmplSeedCorpus))
 	template.Must(tmpls.Parse(tmplSource))
 	template.Must(tmpls.Parse(tmplStruct))
 	template.Must(tmpls.Parse(tmplTable))
 	template.Must(tmpls.Parse(tmplUnion))
+	template.Must(tmpls.Parse(tmplValidateRejection))
 
 	return &FidlGenerator{
 		tmpls: tmpls,
@@ -72,6 +90,12 @@ func (gen *FidlGenerator) GenerateDecoderEncoderSource(wr io.Writer, tree cpp.Ro
 	return gen.tmpls.ExecuteTemplate(wr, "DecoderEncoderSource", tree)
 }
 
+// GenerateDecoderEncoderMutator generates a structure-aware custom mutator for
+// the decoder-encoder fuzzers.
+func (gen *FidlGenerator) GenerateDecoderEncoderMutator(wr io.Writer, tree cpp.Root) error {
+	return gen.tmpls.ExecuteTemplate(wr, "DecoderEncoderMutator", tree)
+}
+
 // Config is the configuration data passed to the libfuzzer generator.
 type Config interface {
 	cpp.CodegenOptions
@@ -80,14 +104,48 @@ type Config interface {
 	DecoderEncoderSource() string
 	HlcppBindingsIncludeStem() string
 	WireBindingsIncludeStem() string
+	// CustomMutator returns whether to emit an LLVMFuzzerCustomMutator
+	// alongside the decoder-encoders.
+	CustomMutator() bool
+	// MemberCoverage returns whether the decoder-encoders of value types
+	// should report which union members each decoded message reached.
+	MemberCoverage() bool
+	// ValidateUnionEnvelopes returns whether the decoder-encoders of value
+	// types should check that the decoded envelope of each union matches the
+	// shape of its member.
+	ValidateUnionEnvelopes() bool
+	// SeedCorpusManifest returns the path of the manifest listing the golden
+	// messages to seed the fuzzing corpus with, or "" for none.
+	SeedCorpusManifest() string
+	// PartialDecode returns whether the decoder-encoders of structs and tables
+	// should also decode the prefixes of each message, to exercise the length
+	// checks of the decoder on short buffers.
+	PartialDecode() bool
 }
 
 // GenerateFidl generates all files required for the C++ libfuzzer code.
+//
+// TODO: Also generate Google Benchmark encode/decode benchmarks per type.
+// These need a representative, valid instance of each type to encode, and the
+// generators have no such factory yet (decoder/encoders start from fuzzer
+// bytes, and default constructed unions cannot be encoded).
 func (gen FidlGenerator) GenerateFidl(fidl fidlgen.Root, c Config, clangFormatPath string) error {
 	options, err := headerOptions(fidl.Name, c)
 	if err != nil {
 		return err
 	}
+	var seedInputs []seedInput
+	if c.SeedCorpusManifest() != "" {
+		if seedInputs, err = readSeedCorpus(c.SeedCorpusManifest()); err != nil {
+			return err
+		}
+	}
+	gen.tmpls.Funcs(template.FuncMap{
+		"MemberCoverage":         c.MemberCoverage,
+		"ValidateUnionEnvelopes": c.ValidateUnionEnvelopes,
+		"SeedInputs":             func() []seedInput { return seedInputs },
+		"PartialDecode":          c.PartialDecode,
+	})
 	tree := cpp.CompileLibFuzzer(fidl, options)
 	if err := os.MkdirAll(filepath.Dir(c.Header()), os.ModePerm); err != nil {
 		return err
@@ -190,7 +248,15 @@ func (gen FidlGenerator) generateDecoderEncoders(fidl fidlgen.Root, tree cpp.Roo
 	}
 	defer sourceFormatterPipe.Close()
 
-	return gen.GenerateDecoderEncoderSource(sourceFormatterPipe, tree)
+	if err := gen.GenerateDecoderEncoderSource(sourceFormatterPipe, tree); err != nil {
+		return err
+	}
+
+	if c.CustomMutator() {
+		return gen.GenerateDecoderEncoderMutator(sourceFormatterPipe, tree)
+	}
+
+	return nil
 }
 
 func headerOptions(name fidlgen.EncodedLibraryIdentifier, c Config) (cpp.HeaderOptions, error) {
@@ -216,20 +282,274 @@ func protocols(decls []cpp.Kinded) []cpp.Protocol {
 	return protocols
 }
 
+func unions(decls []cpp.Kinded) []cpp.Union {
+	unions := make([]cpp.Union, 0, len(decls))
+	for _, decl := range decls {
+		if decl.Kind() == cpp.Kinds.Union {
+			unions = append(unions, decl.(cpp.Union))
+		}
+	}
+	return unions
+}
+
+// unusedOrdinal returns an ordinal that no member of the union uses.
+func unusedOrdinal(u cpp.Union) uint64 {
+	var max uint64
+	for _, m := range u.Members {
+		if m.Ordinal > max {
+			max = m.Ordinal
+		}
+	}
+	return max + 1
+}
+
+// unionTag is the offset of the tag of a union which is inline in a message.
+type unionTag struct {
+	Offset int
+	Union  cpp.Union
+}
+
+// unionTagTable is the union tags at fixed offsets in the messages of one
+// decoder-encoder type.
+type unionTagTable struct {
+	Type string
+	Tags []unionTag
+}
+
+// unionTagTables returns the union tags of each struct and method message of
+// the library which has any, for the custom mutator. Unions nested in inline
+// structs are included; those in tables, vectors, arrays and boxes are not at
+// a fixed offset, and are left out.
+func unionTagTables(decls []cpp.Kinded) []unionTagTable {
+	byName := declsByName(decls)
+	var appendTags func(tags []unionTag, t cpp.Type, offset int) []unionTag
+	appendTags = func(tags []unionTag, t cpp.Type, offset int) []unionTag {
+		if t.WirePointer {
+			return tags
+		}
+		switch d := byName[t.Wire.String()].(type) {
+		case cpp.Union:
+			if len(d.Members) > 0 {
+				tags = append(tags, unionTag{Offset: offset, Union: d})
+			}
+		case cpp.Struct:
+			for _, m := range d.Members {
+				tags = appendTags(tags, m.Type, offset+m.Offset)
+			}
+		}
+		return tags
+	}
+	var tables []unionTagTable
+	add := func(typeName string, params []cpp.Parameter) {
+		var tags []unionTag
+		for _, p := range params {
+			tags = appendTags(tags, p.Type, p.Offset)
+		}
+		if len(tags) > 0 {
+			tables = append(tables, unionTagTable{Type: typeName, Tags: tags})
+		}
+	}
+	for _, decl := range decls {
+		switch d := decl.(type) {
+		case cpp.Struct:
+			var params []cpp.Parameter
+			for _, m := range d.Members {
+				params = append(params, m.AsParameter())
+			}
+			add(d.Wire.String(), params)
+		case cpp.Protocol:
+			if _, ok := d.Transports()["Channel"]; !ok {
+				continue
+			}
+			for _, m := range d.Methods {
+				if m.HasRequest {
+					add(m.WireRequest.String(), m.RequestArgs)
+				}
+				if m.HasResponse && (m.HasRequest || len(m.ResponseArgs) > 0) {
+					add(m.WireResponse.String(), m.ResponseArgs)
+				}
+			}
+		}
+	}
+	return tables
+}
+
+// taggedUnions returns the distinct unions with tags in |tables|.
+func taggedUnions(tables []unionTagTable) []cpp.Union {
+	var unions []cpp.Union
+	seen := make(map[string]bool)
+	for _, table := range tables {
+		for _, tag := range table.Tags {
+			if name := tag.Union.Wire.String(); !seen[name] {
+				seen[name] = true
+				unions = append(unions, tag.Union)
+			}
+		}
+	}
+	return unions
+}
+
+// handleRights is the object type and rights that a handle in a message must
+// have to be accepted by the decoder.
+type handleRights struct {
+	ObjectType string
+	Rights     string
+}
+
+// maxMessageHandles is ZX_CHANNEL_MAX_MSG_HANDLES, the most handles a message
+// may carry.
+const maxMessageHandles = 64
+
+// expectedHandleRights returns the object types and rights of the handles of
+// a message of the resource struct or table |decl|, in the order in which the
+// decoder traverses them, looking through nested declarations of the library.
+// The handles of a vector which no other handle follows are repeated up to the
+// bound of the vector, so that those of a shorter vector are a prefix. It
+// returns nil when the handles cannot be listed ahead of time, such as when
+// the message holds nullable or union members, or flexible envelopes which may
+// carry unknown handles.
+func expectedHandleRights(decls []cpp.Kinded, decl cpp.Kinded) []handleRights {
+	byName := declsByName(decls)
+
+	var rights []handleRights
+	// Whether a vector of handles was listed, after which positions are unknown.
+	afterVector := false
+	unknown := false
+	add := func(r handleRights) {
+		if afterVector {
+			unknown = true
+			return
+		}
+		rights = append(rights, r)
+	}
+	var visitDecl func(d cpp.Kinded)
+	var visitType func(t cpp.Type, info *cpp.HandleInformation)
+	visitType = func(t cpp.Type, info *cpp.HandleInformation) {
+		if !t.IsResource || unknown {
+			return
+		}
+		if t.Nullable && t.Kind != cpp.TypeKinds.Vector {
+			// An absent handle or object shifts the handles which follow it.
+			unknown = true
+			return
+		}
+		switch t.Kind {
+		case cpp.TypeKinds.Handle:
+			if info == nil {
+				unknown = true
+				return
+			}
+			add(handleRights{ObjectType: info.ObjectType, Rights: info.Rights})
+		case cpp.TypeKinds.Request, cpp.TypeKinds.Protocol:
+			add(handleRights{ObjectType: "ZX_OBJ_TYPE_CHANNEL", Rights: "ZX_RIGHT_SAME_RIGHTS"})
+		case cpp.TypeKinds.Array:
+			for i := 0; i < t.ElementCount; i++ {
+				visitType(*t.ElementType, info)
+			}
+		case cpp.TypeKinds.Vector:
+			if afterVector {
+				unknown = true
+				return
+			}
+			// List the handles of one element on their own, then repeat them.
+			outer := rights
+			rights = nil
+			visitType(*t.ElementType, info)
+			element := rights
+			rights = outer
+			if unknown || afterVector || len(element) == 0 {
+				// An element holding a vector has a number of handles known
+				// only once decoded.
+				unknown = unknown || afterVector
+				return
+			}
+			for n := 0; (t.MaxElements == 0 || n < t.MaxElements) && len(rights) < maxMessageHandles; n++ {
+				rights = append(rights, element...)
+			}
+			afterVector = true
+		case cpp.TypeKinds.Struct:
+			d, ok := byName[t.Wire.String()]
+			if !ok {
+				// Declared in another library.
+				unknown = true
+				return
+			}
+			visitDecl(d)
+		default:
+			// Tables and unions hold the handles of members known only once
+			// decoded.
+			unknown = true
+		}
+	}
+	visitDecl = func(d cpp.Kinded) {
+		s, ok := d.(cpp.Struct)
+		if !ok {
+			unknown = true
+			return
+		}
+		for _, m := range s.Members {
+			visitType(m.Type, m.HandleInformation)
+		}
+	}
+	visitDecl(decl)
+	if unknown {
+		return nil
+	}
+	return rights
+}
+
+// declsByName maps the wire names of the structs, tables, and unions of the
+// library to their declarations.
+func declsByName(decls []cpp.Kinded) map[string]cpp.Kinded {
+	byName := make(map[string]cpp.Kinded)
+	for _, d := range decls {
+		switch d := d.(type) {
+		case cpp.Struct:
+			byName[d.Wire.String()] = d
+		case cpp.Table:
+			byName[d.Wire.String()] = d
+		case cpp.Union:
+			byName[d.Wire.String()] = d
+		}
+	}
+	return byName
+}
+
+// walkMembers returns C++ statements that pass |value|, of type |t|, or each
+// of its elements to the DecodedWalk specialization of its declaration. Types
+// declared in other libraries have no specialization, and are skipped.
+func walkMembers(decls []cpp.Kinded, t cpp.Type, value string) string {
+	return walkMembersAt(declsByName(decls), t, value, 0)
+}
+
+func walkMembersAt(byName map[string]cpp.Kinded, t cpp.Type, value string, depth int) string {
+	switch t.Kind {
+	case cpp.TypeKinds.Array, cpp.TypeKinds.Vector:
+		elem := fmt.Sprintf("e%d", depth)
+		inner := walkMembersAt(byName, *t.ElementType, elem, depth+1)
+		if inner == "" {
+			return ""
+		}
+		return fmt.Sprintf("for (const auto& %s : %s) {\n%s\n}", elem, value, inner)
+	case cpp.TypeKinds.Struct, cpp.TypeKinds.Table, cpp.TypeKinds.Union:
+		if _, ok := byName[t.Wire.String()]; !ok {
+			return ""
+		}
+		if t.WirePointer {
+			return fmt.Sprintf("if (%s != nullptr) {\nDecodedWalk<%s>::Walk(*%s);\n}", value, t.Wire, value)
+		}
+		return fmt.Sprintf("DecodedWalk<%s>::Walk(%s);", t.Wire, value)
+	}
+	return ""
+}
+
 // countDecoderEncoders duplicates template logic that inlines protocol, struct, and table
 // decode/encode callbacks to get a count of total callbacks.
 func countDecoderEncoders(decls []cpp.Kinded) int {
 	count := 0
 	for _, decl := range decls {
 		if p, ok := decl.(cpp.Protocol); ok {
-			for _, method := range p.Methods {
-				if method.HasRequest {
-					count++
-				}
-				if method.HasResponse {
-					count++
-				}
-			}
+			count += countProtocolDecoderEncoders(p)
 		} else if _, ok := decl.(cpp.Struct); ok {
 			count++
 		} else if _, ok := decl.(cpp.Table); ok {
@@ -239,6 +559,19 @@ func countDecoderEncoders(decls []cpp.Kinded) int {
 	return count
 }
 
+func countProtocolDecoderEncoders(p cpp.Protocol) int {
+	count := 0
+	for _, method := range p.Methods {
+		if method.HasRequest {
+			count++
+		}
+		if method.HasResponse && (method.HasRequest || len(method.ResponseArgs) > 0) {
+			count++
+		}
+	}
+	return count
+}
+
 // decoderEncoderCodegenOptions is a forwarding CodegenOptions that changes the
 // primary header to the decoder-encoder header.
 type decoderEncoderCodegenOptions struct {
@@ -0,0 +1,130 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const tmplDecodedWalk = `
+{{- define "DecodedWalk" -}}
+
+{{- /* These are shared by the decoder-encoder headers of all libraries. */}}
+#ifndef FIDL_FUZZING_DECODED_WALK_
+#define FIDL_FUZZING_DECODED_WALK_
+
+// Walks a decoded value of |T|, visiting the active member of each union.
+// With -member-coverage, each union member has a Reached function that is
+// called when a decoded union selects it, so that the coverage of those
+// functions shows which members the fuzzer reached. With
+// -validate-union-envelopes, the envelope of each union is checked against
+// the shape of its member.
+template <typename T>
+struct DecodedWalk;
+
+// Decodes a copy of the message, walks it with |DecodedWalk<T>|, and then
+// runs the decoder-encoder of |T| on the original. The decoder works in place,
+// which is why the copy is needed; std::vector storage is suitably aligned
+// for FIDL_ALIGNMENT.
+template <typename T>
+::fidl::fuzzing::DecoderEncoderStatus DecoderEncoderWithDecodedWalk(
+    uint8_t* bytes, uint32_t num_bytes, zx_handle_info_t* handles, uint32_t num_handles) {
+  ::std::vector<uint8_t> copy(bytes, bytes + num_bytes);
+  ::fidl::DecodedMessage<T> decoded(copy.data(), num_bytes);
+  if (decoded.ok()) {
+    DecodedWalk<T>::Walk(*decoded.PrimaryObject());
+  }
+  return ::fidl::fuzzing::DecoderEncoderImpl<T>(bytes, num_bytes, handles, num_handles);
+}
+
+#endif  // FIDL_FUZZING_DECODED_WALK_
+{{- range .Decls }}
+{{- if or (Eq .Kind Kinds.Struct) (Eq .Kind Kinds.Table) (Eq .Kind Kinds.Union) }}
+{{- if not .IsResourceType }}
+
+template <>
+struct DecodedWalk<{{ .Wire }}> {
+  static void Walk(const {{ .Wire }}& value);
+  {{- if and MemberCoverage (Eq .Kind Kinds.Union) }}
+  {{- range .Members }}
+  [[gnu::noinline]] static void Reached_{{ .Wire.Name }}() { asm volatile(""); }
+  {{- end }}
+  {{- end }}
+};
+{{- end }}
+{{- end }}
+{{- end }}
+{{- range $decl := .Decls }}
+{{- if or (Eq .Kind Kinds.Struct) (Eq .Kind Kinds.Table) (Eq .Kind Kinds.Union) }}
+{{- if not .IsResourceType }}
+{{- if Eq .Kind Kinds.Struct }}
+
+inline void DecodedWalk<{{ .Wire }}>::Walk(const {{ .Wire }}& value) {
+  {{- range .Members }}
+  {{- with WalkMembers $.Decls .Type (printf "value.%s" .Wire.Name) }}
+  {{ . }}
+  {{- end }}
+  {{- end }}
+}
+{{- else if Eq .Kind Kinds.Table }}
+
+inline void DecodedWalk<{{ .Wire }}>::Walk(const {{ .Wire }}& value) {
+  {{- range $member := .Members }}
+  {{- with WalkMembers $.Decls .Type (printf "value.%s()" .Wire.Name) }}
+  if (value.has_{{ $member.Wire.Name }}()) {
+    {{ . }}
+  }
+  {{- end }}
+  {{- end }}
+}
+{{- else if Eq .Kind Kinds.Union }}
+
+inline void DecodedWalk<{{ .Wire }}>::Walk(const {{ .Wire }}& value) {
+  if (value.has_invalid_tag()) {
+    return;
+  }
+  {{- if ValidateUnionEnvelopes }}
+  // The union has the layout of a fidl_xunion_t, with the envelope as decoded.
+  [[maybe_unused]] const fidl_envelope_t& envelope =
+      reinterpret_cast<const fidl_xunion_t*>(&value)->envelope;
+  {{- end }}
+  switch (value.which()) {
+  {{- range .Members }}
+  {{- if .IsExperimental }}
+#ifdef FIDL_ALLOW_EXPERIMENTAL
+  {{- end }}
+    case {{ .TagName.Wire }}:
+      {{- if MemberCoverage }}
+      Reached_{{ .Wire.Name }}();
+      {{- end }}
+      {{- if ValidateUnionEnvelopes }}
+      {{- if eq .MaxOutOfLine 0 }}
+      ZX_ASSERT_MSG(envelope.num_bytes == FIDL_ALIGN(sizeof({{ .Type.Wire }})),
+                    "decoded {{ $decl.Wire }}.{{ .Wire.Name }} with %u envelope bytes", envelope.num_bytes);
+      {{- else if ge .MaxOutOfLine 4294967295 }}
+      ZX_ASSERT_MSG(envelope.num_bytes >= FIDL_ALIGN(sizeof({{ .Type.Wire }})),
+                    "decoded {{ $decl.Wire }}.{{ .Wire.Name }} with %u envelope bytes", envelope.num_bytes);
+      {{- else }}
+      ZX_ASSERT_MSG(envelope.num_bytes >= FIDL_ALIGN(sizeof({{ .Type.Wire }})) &&
+                    envelope.num_bytes - FIDL_ALIGN(sizeof({{ .Type.Wire }})) <= {{ .MaxOutOfLine }}u,
+                    "decoded {{ $decl.Wire }}.{{ .Wire.Name }} with %u envelope bytes", envelope.num_bytes);
+      {{- end }}
+      ZX_ASSERT_MSG(envelope.num_handles == 0,
+                    "decoded {{ $decl.Wire }}.{{ .Wire.Name }} with %u envelope handles", envelope.num_handles);
+      {{- end }}
+      {{- with WalkMembers $.Decls .Type (printf "value.%s()" .Wire.Name) }}
+      {{ . }}
+      {{- end }}
+      break;
+  {{- if .IsExperimental }}
+#endif
+  {{- end }}
+  {{- end }}
+    default:
+      break;
+  }
+}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+`
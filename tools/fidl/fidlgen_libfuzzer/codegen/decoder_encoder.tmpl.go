@@ -9,7 +9,19 @@ const tmplDecoderEncoder = `
 ::fidl::fuzzing::DecoderEncoderForType{
 	.fidl_type_name = "{{ .Wire }}",
 	.has_flexible_envelope = {{ .HasFlexibleEnvelope }},
-	.decoder_encoder = ::fidl::fuzzing::DecoderEncoderImpl<{{ .Wire }}>,
+	{{- /* Decoding a copy of a message to walk it would take its handles, so
+	       resource types are not walked. */}}
+	{{- $decoderEncoder := printf "::fidl::fuzzing::DecoderEncoderImpl<%s>" .Wire }}
+	{{- if .IsResourceType }}
+	{{- $decoderEncoder = printf "::fuzzing::DecoderEncoderWithHandleRights<%s>" .Wire }}
+	{{- else if or MemberCoverage ValidateUnionEnvelopes }}
+	{{- $decoderEncoder = printf "::fuzzing::DecoderEncoderWithDecodedWalk<%s>" .Wire }}
+	{{- end }}
+	{{- if PartialDecode }}
+	.decoder_encoder = ::fuzzing::DecoderEncoderWithPartialDecode<{{ .Wire }}, {{ $decoderEncoder }}>,
+	{{- else }}
+	.decoder_encoder = {{ $decoderEncoder }},
+	{{- end }}
 },
 {{- end -}}
 `
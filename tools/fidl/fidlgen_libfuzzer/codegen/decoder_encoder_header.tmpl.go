@@ -17,8 +17,23 @@ const tmplDecoderEncoderHeader = `
 
 // For ::fidl::fuzzing::DecoderEncoderImpl.
 #include <lib/fidl/cpp/fuzzing/decoder_encoder.h>
+{{- if PartialDecode }}
+// For ::std::min.
+#include <algorithm>
+{{- end }}
+{{- if or MemberCoverage ValidateUnionEnvelopes PartialDecode }}
+// For ::std::vector.
+#include <vector>
+{{- end }}
 
 namespace fuzzing {
+{{ template "HandleRights" . }}
+{{- if or MemberCoverage ValidateUnionEnvelopes }}
+{{ template "DecodedWalk" . }}
+{{- end }}
+{{- if PartialDecode }}
+{{ template "PartialDecode" . }}
+{{- end }}
 
 inline constexpr ::std::array<::fidl::fuzzing::DecoderEncoderForType, {{ CountDecoderEncoders .Decls }}>
 {{ range .Library }}{{ . }}_{{ end }}decoder_encoders = {
@@ -32,6 +47,21 @@ inline constexpr ::std::array<::fidl::fuzzing::DecoderEncoderForType, {{ CountDe
 {{- end }}
 };
 
+{{- /* Per-protocol subsets of the above, for fuzzing one protocol at a time. */}}
+{{ range .Decls }}
+{{- if Eq .Kind Kinds.Protocol -}}{{ $protocol := . }}
+{{ range $transport, $_ := .Transports -}}{{ if eq $transport "Channel" -}}
+inline constexpr ::std::array<::fidl::fuzzing::DecoderEncoderForType, {{ CountProtocolDecoderEncoders $protocol }}>
+{{ range $.Library }}{{ . }}_{{ end }}{{ $protocol.Wire.Name }}_decoder_encoders = {
+{{ template "ProtocolDecoderEncoders" $protocol }}
+};
+{{- end }}{{ end }}{{ end -}}
+{{- end }}
+{{- if SeedInputs }}
+{{ template "SeedCorpus" . }}
+{{- end }}
+{{ template "ValidateRejection" . }}
+
 }  // namespace fuzzing
 {{ end }}
 `
@@ -0,0 +1,106 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const tmplDecoderEncoderMutator = `
+{{- define "DecoderEncoderMutator" -}}
+{{- $tables := UnionTagTables .Decls }}
+
+// For ::std::minstd_rand.
+#include <random>
+// For ::std::size.
+#include <iterator>
+// For memcpy() and memset().
+#include <string.h>
+
+extern "C" size_t LLVMFuzzerMutate(uint8_t* data, size_t size, size_t max_size);
+
+namespace fuzzing {
+namespace {
+
+{{- if $tables }}
+
+// The ordinals of the members of each union with a tag listed below.
+{{- range TaggedUnions $tables }}
+constexpr uint64_t k{{ .Wire.Name }}Ordinals[] = {
+  {{- range .Members }}
+  {{ .Ordinal }}u,  // {{ .Wire.Name }}
+  {{- end }}
+};
+{{- end }}
+
+// The offset of the tag of a union inline in a message, and the ordinals it
+// may hold.
+struct UnionTag {
+  size_t offset;
+  const uint64_t* ordinals;
+  size_t num_ordinals;
+};
+{{- range $index, $table := $tables }}
+
+// {{ .Type }}
+constexpr UnionTag kUnionTags{{ $index }}[] = {
+  {{- range .Tags }}
+  {.offset = {{ .Offset }}, .ordinals = k{{ .Union.Wire.Name }}Ordinals, .num_ordinals = ::std::size(k{{ .Union.Wire.Name }}Ordinals)},  // {{ .Union.Wire }}
+  {{- end }}
+};
+{{- end }}
+
+// The union tags of each type which has any at a fixed offset. Unions in
+// tables, vectors, arrays and boxes are not listed.
+struct UnionTags {
+  const UnionTag* tags;
+  size_t num_tags;
+};
+constexpr UnionTags kUnionTagsByType[] = {
+{{- range $index, $table := $tables }}
+  {.tags = kUnionTags{{ $index }}, .num_tags = ::std::size(kUnionTags{{ $index }})},
+{{- end }}
+};
+{{- end }}
+
+}  // namespace
+}  // namespace fuzzing
+
+// Mutates one FIDL_ALIGNMENT-sized word at a time, so that the members that
+// follow it do not shift. The word is picked at random, without knowing the
+// type of the message.
+{{- if $tables }}
+// Sometimes, the mutator instead picks one of the types at random, and writes
+// the ordinal of a member of a union over the tag of that union in the layout
+// of the type, which switches the active member while keeping the message
+// decodable as that type.
+{{- end }}
+extern "C" size_t LLVMFuzzerCustomMutator(uint8_t* data, size_t size, size_t max_size,
+                                          unsigned int seed) {
+  ::std::minstd_rand rng(seed);
+
+{{- if $tables }}
+
+  if (rng() % 8 == 0) {
+    const ::fuzzing::UnionTags& type =
+        ::fuzzing::kUnionTagsByType[rng() % ::std::size(::fuzzing::kUnionTagsByType)];
+    const ::fuzzing::UnionTag& tag = type.tags[rng() % type.num_tags];
+    if (tag.offset + sizeof(uint64_t) <= size) {
+      uint64_t ordinal = tag.ordinals[rng() % tag.num_ordinals];
+      memcpy(data + tag.offset, &ordinal, sizeof(ordinal));
+      return size;
+    }
+  }
+{{- end }}
+
+  const size_t num_words = size / FIDL_ALIGNMENT;
+  if (num_words == 0) {
+    return LLVMFuzzerMutate(data, size, max_size);
+  }
+  uint8_t* word = data + (rng() % num_words) * FIDL_ALIGNMENT;
+  size_t mutated = LLVMFuzzerMutate(word, FIDL_ALIGNMENT, FIDL_ALIGNMENT);
+  if (mutated < FIDL_ALIGNMENT) {
+    memset(word + mutated, 0, FIDL_ALIGNMENT - mutated);
+  }
+  return size;
+}
+{{ end }}
+`
@@ -0,0 +1,80 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const tmplHandleRights = `
+{{- define "HandleRights" -}}
+
+{{- /* These are shared by the decoder-encoder headers of all libraries. */}}
+#ifndef FIDL_FUZZING_HANDLE_RIGHTS_
+#define FIDL_FUZZING_HANDLE_RIGHTS_
+
+struct HandleRights {
+  zx_obj_type_t type;
+  zx_rights_t rights;
+};
+
+// The object types and rights of the handles of a message of |T|, in the order
+// in which the decoder traverses them. |kHandles| is only defined when they can
+// be listed ahead of time; otherwise any handle is acceptable.
+template <typename T>
+struct ExpectedHandleRights {
+  static constexpr bool kKnown = false;
+};
+
+// Runs the decoder-encoder of |T|, and then checks that each handle of a
+// message it decoded has the object type and at least the rights of the field
+// it was decoded into, since the decoder must reject any other handle.
+template <typename T>
+::fidl::fuzzing::DecoderEncoderStatus DecoderEncoderWithHandleRights(
+    uint8_t* bytes, uint32_t num_bytes, zx_handle_info_t* handles, uint32_t num_handles) {
+  if constexpr (!ExpectedHandleRights<T>::kKnown) {
+    return ::fidl::fuzzing::DecoderEncoderImpl<T>(bytes, num_bytes, handles, num_handles);
+  } else {
+    // The decoder-encoder consumes the handles, so copy their information first.
+    zx_handle_info_t infos[ZX_CHANNEL_MAX_MSG_HANDLES];
+    const uint32_t num_infos = ::std::min(num_handles, ZX_CHANNEL_MAX_MSG_HANDLES);
+    ::std::copy(handles, handles + num_infos, infos);
+    ::fidl::fuzzing::DecoderEncoderStatus status =
+        ::fidl::fuzzing::DecoderEncoderImpl<T>(bytes, num_bytes, handles, num_handles);
+    if (status.progress < ::fidl::fuzzing::DecoderEncoderProgress::FirstDecodeSuccess) {
+      return status;
+    }
+    constexpr uint32_t kNumExpected = ::std::size(ExpectedHandleRights<T>::kHandles);
+    ZX_ASSERT_MSG(num_handles <= kNumExpected, "decoded %u handles, more than the %u of |T|",
+                  num_handles, kNumExpected);
+    for (uint32_t i = 0; i < num_infos; i++) {
+      const HandleRights& e = ExpectedHandleRights<T>::kHandles[i];
+      const bool expected =
+          (e.type == ZX_OBJ_TYPE_NONE || e.type == infos[i].type) &&
+          (e.rights == ZX_RIGHT_SAME_RIGHTS || (infos[i].rights & e.rights) == e.rights);
+      ZX_ASSERT_MSG(expected, "decoded handle %u of type %u with rights 0x%x, not %u with 0x%x", i,
+                    infos[i].type, infos[i].rights, e.type, e.rights);
+    }
+    return status;
+  }
+}
+
+#endif  // FIDL_FUZZING_HANDLE_RIGHTS_
+{{- range $decl := .Decls }}
+{{- if or (Eq .Kind Kinds.Struct) (Eq .Kind Kinds.Table) }}
+{{- if .IsResourceType }}
+{{- with ExpectedHandleRights $.Decls $decl }}
+
+template <>
+struct ExpectedHandleRights<{{ $decl.Wire }}> {
+  static constexpr bool kKnown = true;
+  static constexpr HandleRights kHandles[] = {
+  {{- range . }}
+    {{ "{" }}{{ .ObjectType }}, {{ .Rights }}{{ "}" }},
+  {{- end }}
+  };
+};
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+`
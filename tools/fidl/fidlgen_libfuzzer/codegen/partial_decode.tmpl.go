@@ -0,0 +1,62 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const tmplPartialDecode = `
+{{- define "PartialDecode" -}}
+
+{{- /* These are shared by the decoder-encoder headers of all libraries. */}}
+#ifndef FIDL_FUZZING_PARTIAL_DECODE_
+#define FIDL_FUZZING_PARTIAL_DECODE_
+
+// The outcome of |PartialDecode|.
+struct PartialDecodeResult {
+  // The length of the shortest prefix of the message which decoded, or the
+  // length of the message if none did.
+  uint32_t consumed_bytes;
+  bool decoded;
+};
+
+// Called with the coding table of |T| and the outcome of |PartialDecode<T>|
+// for each message. Define it to collect how many bytes the decoder consumed.
+extern "C" __attribute__((weak)) void OnPartialDecode(const fidl_type_t* type,
+                                                      uint32_t consumed_bytes, bool decoded);
+
+// Decodes copies of the prefixes of a message of |T|, from the shortest, in
+// steps of FIDL_ALIGNMENT, up to the whole message. Each copy is allocated to
+// the exact length of its prefix, so that ASan reports a decoder which misses
+// a length check and reads past the end of a short buffer. A message of n
+// bytes thus costs up to n / FIDL_ALIGNMENT copies and decodes. No handles are
+// passed to the decoder, so the prefixes of resource types which hold any do
+// not decode.
+template <typename T>
+PartialDecodeResult PartialDecode(const uint8_t* bytes, uint32_t num_bytes) {
+  uint32_t length = 0;
+  while (length < num_bytes) {
+    length = ::std::min(length + FIDL_ALIGNMENT, num_bytes);
+    ::std::vector<uint8_t> prefix(bytes, bytes + length);
+    ::fidl::DecodedMessage<T> decoded(prefix.data(), length);
+    if (decoded.ok()) {
+      return PartialDecodeResult{.consumed_bytes = length, .decoded = true};
+    }
+  }
+  return PartialDecodeResult{.consumed_bytes = num_bytes, .decoded = false};
+}
+
+// Runs |PartialDecode<T>| on the message, reporting its outcome to
+// |OnPartialDecode|, and then |DecoderEncoder| on the whole message.
+template <typename T, auto DecoderEncoder>
+::fidl::fuzzing::DecoderEncoderStatus DecoderEncoderWithPartialDecode(
+    uint8_t* bytes, uint32_t num_bytes, zx_handle_info_t* handles, uint32_t num_handles) {
+  const PartialDecodeResult result = PartialDecode<T>(bytes, num_bytes);
+  if (OnPartialDecode != nullptr) {
+    OnPartialDecode(T::Type, result.consumed_bytes, result.decoded);
+  }
+  return DecoderEncoder(bytes, num_bytes, handles, num_handles);
+}
+
+#endif  // FIDL_FUZZING_PARTIAL_DECODE_
+{{- end }}
+`
@@ -17,7 +17,7 @@ const tmplProtocolDecoderEncoders = `
 },
 {{- end -}}
 
-{{- if .HasResponse }}
+{{- if and .HasResponse .HasRequest }}
 ::fidl::fuzzing::DecoderEncoderForType{
 	.fidl_type_name = "{{ .WireResponse }}",
 	.has_flexible_envelope = {{ .Response.HasFlexibleEnvelope }},
@@ -25,6 +25,15 @@ const tmplProtocolDecoderEncoders = `
 },
 {{- end -}}
 
+{{- /* Events are sent by servers, so only their payloads are fuzzed. */}}
+{{- if and .HasResponse (not .HasRequest) .ResponseArgs }}
+::fidl::fuzzing::DecoderEncoderForType{
+	.fidl_type_name = "{{ $.Wire.Name }}_{{ .Wire.Name }}_Event",
+	.has_flexible_envelope = {{ .Response.HasFlexibleEnvelope }},
+	.decoder_encoder = ::fidl::fuzzing::DecoderEncoderImpl<{{ .WireResponse }}>,
+},
+{{- end -}}
+
 {{- end -}}
 
 {{- end -}}
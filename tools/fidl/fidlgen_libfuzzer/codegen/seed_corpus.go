@@ -0,0 +1,68 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// seedInput is a golden message to seed the fuzzing corpus with.
+type seedInput struct {
+	// FidlTypeName is the type of the message, as the fidl_type_name of its
+	// decoder-encoder, e.g. "::fuchsia_library::wire::MyStruct".
+	FidlTypeName string
+	data         []byte
+}
+
+// Bytes returns the message as the elements of a C++ array initializer.
+func (s seedInput) Bytes() string {
+	bytes := make([]string, len(s.data))
+	for i, b := range s.data {
+		bytes[i] = fmt.Sprintf("%#02x", b)
+	}
+	return strings.Join(bytes, ", ")
+}
+
+// readSeedCorpus reads the golden messages listed by |manifest|, which has a
+// line per message with the path of its file, relative to the manifest, and
+// the name of its type. Blank lines and lines starting with # are ignored.
+func readSeedCorpus(manifest string) ([]seedInput, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var inputs []seedInput
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a path and a type name", manifest, line)
+		}
+		path := filepath.Join(filepath.Dir(manifest), fields[0])
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("%s:%d: %s is empty", manifest, line, path)
+		}
+		inputs = append(inputs, seedInput{FidlTypeName: fields[1], data: data})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inputs, nil
+}
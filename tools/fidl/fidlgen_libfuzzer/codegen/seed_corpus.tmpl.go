@@ -0,0 +1,24 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const tmplSeedCorpus = `
+{{- define "SeedCorpus" }}
+{{- range $index, $input := SeedInputs }}
+inline constexpr uint8_t {{ range $.Library }}{{ . }}_{{ end }}seed_input_{{ $index }}[] = { {{ .Bytes }} };
+{{- end }}
+
+// Passes each golden message of the seed corpus manifest, with the name of
+// its type as in |decoder_encoders|, to |add|, e.g. to write the initial
+// corpus of the fuzzers.
+inline void {{ range .Library }}{{ . }}_{{ end }}register_seed_corpus(
+    void (*add)(const char* fidl_type_name, const uint8_t* data, size_t size)) {
+{{- range $index, $input := SeedInputs }}
+  add("{{ .FidlTypeName }}", {{ range $.Library }}{{ . }}_{{ end }}seed_input_{{ $index }},
+      sizeof({{ range $.Library }}{{ . }}_{{ end }}seed_input_{{ $index }}));
+{{- end }}
+}
+{{- end }}
+`
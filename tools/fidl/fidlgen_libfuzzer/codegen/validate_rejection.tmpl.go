@@ -0,0 +1,62 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const tmplValidateRejection = `
+{{- define "ValidateRejection" -}}
+{{- $unions := Unions .Decls }}
+{{- if $unions }}
+
+{{- /* These are shared by the decoder-encoder headers of all libraries. */}}
+#ifndef FIDL_FUZZING_VALIDATE_REJECTION_
+#define FIDL_FUZZING_VALIDATE_REJECTION_
+
+// Decodes, in place, a |T| holding a zero-filled member under |ordinal|.
+template <typename T>
+struct UnionWithOrdinal {
+  explicit UnionWithOrdinal(uint64_t ordinal) {
+    message.header.tag = ordinal;
+    message.header.envelope.num_bytes = FIDL_ALIGNMENT;
+    message.header.envelope.presence = FIDL_ALLOC_PRESENT;
+    const char* error = nullptr;
+    decoded = fidl_decode_etc(T::Type, &message, sizeof(message), nullptr, 0, &error) == ZX_OK;
+  }
+
+  const T& value() const { return *reinterpret_cast<const T*>(&message); }
+
+  struct {
+    fidl_xunion_t header;
+    alignas(FIDL_ALIGNMENT) uint8_t data[FIDL_ALIGNMENT];
+  } message = {};
+  bool decoded = false;
+};
+
+// Returns whether the decoder handles an ordinal that no member of union |T|
+// uses correctly: strict unions must reject it, and flexible unions must
+// accept it as an unknown member.
+template <typename T>
+bool ValidateRejection();
+
+#endif  // FIDL_FUZZING_VALIDATE_REJECTION_
+{{- range $unions }}
+{{ if .IsResourceType }}
+#ifdef __Fuchsia__
+{{- end }}
+template <>
+inline bool ValidateRejection<{{ .Wire }}>() {
+  UnionWithOrdinal<{{ .Wire }}> u({{ UnusedOrdinal . }}u);
+  {{- if .IsFlexible }}
+  return u.decoded && u.value().which() == {{ .Wire }}::Tag::kUnknown;
+  {{- else }}
+  return !u.decoded;
+  {{- end }}
+}
+{{- if .IsResourceType }}
+#endif  // __Fuchsia__
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+`
@@ -20,6 +20,11 @@ type flagsDef struct {
 	decoderEncoderSource     *string
 	hlcppBindingsIncludeStem *string
 	wireBindingsIncludeStem  *string
+	customMutator            *bool
+	memberCoverage           *bool
+	validateUnionEnvelopes   *bool
+	seedCorpusManifest       *string
+	partialDecode            *bool
 }
 
 var _ cpp.CodegenOptions = (*flagsDef)(nil)
@@ -57,6 +62,26 @@ func (f flagsDef) WireBindingsIncludeStem() string {
 	return *f.wireBindingsIncludeStem
 }
 
+func (f flagsDef) CustomMutator() bool {
+	return *f.customMutator
+}
+
+func (f flagsDef) MemberCoverage() bool {
+	return *f.memberCoverage
+}
+
+func (f flagsDef) ValidateUnionEnvelopes() bool {
+	return *f.validateUnionEnvelopes
+}
+
+func (f flagsDef) SeedCorpusManifest() string {
+	return *f.seedCorpusManifest
+}
+
+func (f flagsDef) PartialDecode() bool {
+	return *f.partialDecode
+}
+
 var flags = flagsDef{
 	CommonFlags: cpp.CommonFlags{
 		Json: flag.String("json", "",
@@ -86,6 +111,30 @@ var flags = flagsDef{
 		"llcpp/fidl",
 		"[optional] the path stem when including the wire bindings header. "+
 			"Includes will be of the form <my/library/{include-stem}.h>. "),
+	customMutator: flag.Bool("custom-mutator", false,
+		"[optional] emit a structure-aware LLVMFuzzerCustomMutator into the "+
+			"decoder-encoder implementation."),
+	memberCoverage: flag.Bool("member-coverage", false,
+		"[optional] have the decoder-encoders of value types call a function "+
+			"per union member reached by a decoded message, so that coverage "+
+			"reports show which members were fuzzed. Resource types are not "+
+			"covered, since walking a decoded copy would take its handles."),
+	validateUnionEnvelopes: flag.Bool("validate-union-envelopes", false,
+		"[optional] have the decoder-encoders of value types assert that the "+
+			"envelope of each decoded union has a size consistent with its member, "+
+			"and no handles. Like -member-coverage, this skips resource types."),
+	seedCorpusManifest: flag.String("seed-corpus-manifest", "",
+		"[optional] a manifest of golden messages, with a line per message holding "+
+			"the path of its file, relative to the manifest, and the name of its type "+
+			"as in the decoder-encoders. The decoder-encoder header then has a function "+
+			"passing each message to a callback, to seed the fuzzing corpus with."),
+	partialDecode: flag.Bool("partial-decode", false,
+		"[optional] have the decoder-encoders of structs and tables also decode "+
+			"every prefix of each message, to exercise the length checks of the "+
+			"decoder on short buffers, and report the shortest prefix which decoded "+
+			"to OnPartialDecode(), if it is defined. This costs up to one decode per "+
+			"FIDL_ALIGNMENT bytes of each message. It combines with the other "+
+			"decoder-encoder flags."),
 }
 
 func (f flagsDef) valid() bool {
@@ -6,11 +6,14 @@ package codegen
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"text/template"
 
 	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
@@ -21,6 +24,274 @@ type Generator struct {
 	tmpls *template.Template
 }
 
+// Options controls optional features of the generated bindings. Each option
+// is exposed to the templates as a function of the same name.
+type Options struct {
+	// HostStub emits host stubs of resource unions, with handles replaced by
+	// inert zx_handle_t values, instead of omitting them on host.
+	HostStub bool
+
+	// ZeroUnionPadding zeroes the whole primary object of unions in their
+	// default constructor in debug builds. Unions have no padding, but this
+	// silences static analyzers which assume they do.
+	ZeroUnionPadding bool
+
+	// ByValueGetterMaxSize makes the const getters of primitive, bits and
+	// enum union members of up to this many bytes return by value. Zero
+	// disables the feature.
+	ByValueGetterMaxSize int
+
+	// DestructorHook makes resource unions call the weak function
+	// OnUnionDestroyed, if defined, before closing their handles.
+	DestructorHook bool
+
+	// ExposeRaw adds unsafe accessors to the underlying representation of
+	// unions, for custom codecs.
+	ExposeRaw bool
+
+	// AccessCoverage counts the calls to the accessors of each union member
+	// and prints the counts at exit, to find members that tests miss.
+	AccessCoverage bool
+
+	// EmitFidlText generates ToFidlText(), which renders unions, structs and
+	// tables in the FIDL text format, for golden tests.
+	EmitFidlText bool
+
+	// NaturalVariantUnions generates a std::variant backed natural::MyUnion
+	// with value semantics next to each wire union whose members all have a
+	// natural counterpart, with conversions between the two. Unions holding
+	// structs or tables get none.
+	NaturalVariantUnions bool
+
+	// RangeCompat adds begin() and end() to unions, which range over the union
+	// itself when it has a valid tag, so that generic code can treat unions
+	// like optional values in range-based for loops.
+	RangeCompat bool
+
+	// UniformPresence adds PresenceMask() to unions, which reports the
+	// active member in the same bit layout as a table's presence bitmap.
+	UniformPresence bool
+
+	// AbslHash adds an |AbslHashValue| friend to value unions, so that they
+	// can be used as keys of Abseil hash containers.
+	AbslHash bool
+
+	// LenientGetters adds x_or_default() accessors to union members without
+	// handles, which log a warning and return a default value instead of
+	// asserting when the union holds a different member.
+	LenientGetters bool
+
+	// UnionConversions are the conversion functions to generate from unions
+	// of the library to structurally identical unions of other libraries.
+	UnionConversions []cpp.UnionConversion
+
+	// FitResultGetters adds x_result() accessors to union members, which
+	// return fit::failed instead of asserting when the union holds a
+	// different member.
+	FitResultGetters bool
+
+	// Lifetimebound annotates the reference getters of union members with
+	// [[clang::lifetimebound]], so that Clang warns when one is called on a
+	// temporary union.
+	Lifetimebound bool
+
+	// StoragePolicy is the type unions hold the out-of-line storage of their
+	// active member in, instead of ::fidl::Envelope<void>. It must have the
+	// layout of fidl_envelope_t, and a |data| member that can be used as a
+	// ::fidl::ObjectView<void>.
+	StoragePolicy string
+
+	// HandleBudget, if non-negative, is the most handles any resource union
+	// may carry. Exceeding it fails a static_assert. A budget of 0 restricts
+	// unions to carrying no handles at all.
+	HandleBudget int
+
+	// ArenaBackedUnions generates an ArenaBackedX class for each union X,
+	// which owns the arena backing the out-of-line data of the union it
+	// holds.
+	ArenaBackedUnions bool
+
+	// LazyUnions generates a LazyX class for each union X, which holds a
+	// union X together with the allocator its members are set from.
+	LazyUnions bool
+
+	// LayoutComments documents the wire layout of each union in a comment
+	// above its declaration, for ABI review.
+	LayoutComments bool
+
+	// AssertMacro, if set, is the assertion macro that union getters check
+	// that the union holds their member with, instead of ZX_ASSERT_MSG. It is
+	// called like assert, with a single condition, and must be defined before
+	// the generated header is included.
+	AssertMacro string
+
+	// TraceHandles emits a trace event, naming the member, when a resource
+	// union is set to a member with handles or closes them. The events compile
+	// to nothing when tracing is disabled.
+	TraceHandles bool
+
+	// UnknownMemberPolicy adds HandleUnknownMember() to flexible unions, which
+	// preserves, logs or rejects unknown members according to a policy set
+	// per union type. FromRaw() applies it too.
+	UnknownMemberPolicy bool
+
+	// FlatProjections generates, for each value union, a flat struct with the
+	// ordinal of the active member and one optional column per member, and a
+	// Flatten() function projecting the union into it.
+	FlatProjections bool
+
+	// Hardened makes union getters abort if the out-of-line data of their
+	// member is outside of the bounds of the message being read, as set by a
+	// fidl::HardenedMessageBounds.
+	Hardened bool
+
+	// SimdAlignment, if positive, is the alignment that union members which
+	// are arrays of floats are allocated at by set_x(allocator, ...), and
+	// which aligned_x_data() returns their elements at. It must be a power of
+	// two.
+	SimdAlignment int
+
+	// SetOnce generates a SetOnceX wrapper for each union X, whose members
+	// may only be set once.
+	SetOnce bool
+
+	// TestHelpers adds AssertTag() to unions, which aborts naming the actual
+	// member when a union does not hold the expected one.
+	TestHelpers bool
+
+	// AllocationReport adds ReportAllocation() to unions, which returns the
+	// bytes the member of a union occupies in its arena.
+	AllocationReport bool
+
+	// StructuralComparison generates StructurallyEqual() and operator< for
+	// structs, tables and unions, and Diff() and CompatibleWith() for unions.
+	StructuralComparison bool
+
+	// DeepCopy generates Clone() for value structs, tables and unions, and
+	// Canonicalize(), ToOwned() and the OwnedX and CowX classes for value
+	// unions.
+	DeepCopy bool
+
+	// TypeErasedSet adds Set(tag, std::any, allocator) to unions, which sets the
+	// member selected by a tag from a type-erased value, for scripting bridges.
+	TypeErasedSet bool
+
+	// UnionIntrospection generates GetUnionRegistry(), which describes the
+	// unions of the library, the AnyUnion variant over them,
+	// MakeUnionByName() and the ListMembers() function of each union, for
+	// debugging and replay tools.
+	UnionIntrospection bool
+
+	// UnionEncode adds Encode() and EncodeToIovecs() to unions, which encode
+	// them without going through a channel, for custom transports, and
+	// AppendEncodedBytes() to value unions.
+	UnionEncode bool
+
+	// StructuredBindings adds get<I>() and the std::tuple_size and
+	// std::tuple_element specializations to unions, so that they can be used in
+	// structured bindings binding their tag and active member.
+	StructuredBindings bool
+
+	// Coalesce generates a Coalesce() free function for each union, which returns
+	// the first of several unions with a valid tag.
+	Coalesce bool
+
+	// WireFormat is the wire format that unions are generated for, such as "v1",
+	// which they expose as kWireFormat. Only v1 is supported.
+	WireFormat string
+}
+
+func (o Options) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"HostStub":             func() bool { return o.HostStub },
+		"ZeroUnionPadding":     func() bool { return o.ZeroUnionPadding },
+		"ByValueGetterMaxSize": func() int { return o.ByValueGetterMaxSize },
+		"DestructorHook":       func() bool { return o.DestructorHook },
+		"ExposeRaw":            func() bool { return o.ExposeRaw },
+		"AccessCoverage":       func() bool { return o.AccessCoverage },
+		"EmitFidlText":         func() bool { return o.EmitFidlText },
+		"NaturalVariantUnions": func() bool { return o.NaturalVariantUnions },
+		"RangeCompat":          func() bool { return o.RangeCompat },
+		"UniformPresence":      func() bool { return o.UniformPresence },
+		"AbslHash":             func() bool { return o.AbslHash },
+		"LenientGetters":       func() bool { return o.LenientGetters },
+		"FitResultGetters":     func() bool { return o.FitResultGetters },
+		"Lifetimebound":        func() bool { return o.Lifetimebound },
+		"HandleBudget":         func() int { return o.HandleBudget },
+		"ArenaBackedUnions":    func() bool { return o.ArenaBackedUnions },
+		"LazyUnions":           func() bool { return o.LazyUnions },
+		"LayoutComments":       func() bool { return o.LayoutComments },
+		"TraceHandles":         func() bool { return o.TraceHandles },
+		"UnknownMemberPolicy":  func() bool { return o.UnknownMemberPolicy },
+		"FlatProjections":      func() bool { return o.FlatProjections },
+		"Hardened":             func() bool { return o.Hardened },
+		"SetOnce":              func() bool { return o.SetOnce },
+		"TestHelpers":          func() bool { return o.TestHelpers },
+		"AllocationReport":     func() bool { return o.AllocationReport },
+		"StructuralComparison": func() bool { return o.StructuralComparison },
+		"DeepCopy":             func() bool { return o.DeepCopy },
+		"TypeErasedSet":        func() bool { return o.TypeErasedSet },
+		"UnionIntrospection":   func() bool { return o.UnionIntrospection },
+		"UnionEncode":          func() bool { return o.UnionEncode },
+		"StructuredBindings":   func() bool { return o.StructuredBindings },
+		"Coalesce":             func() bool { return o.Coalesce },
+		// WireFormat is the ::fidl::WireFormatVersion enumerator of the
+		// targeted wire format, e.g. kV1.
+		"WireFormat": func() string { return "k" + strings.ToUpper(o.WireFormat) },
+		// SimdAlignment is the alignment to allocate members of type |t| at,
+		// or 0 if they are not arrays of floats or no alignment was set.
+		"SimdAlignment": func(t cpp.Type) int {
+			if o.SimdAlignment <= 0 || t.Kind != cpp.TypeKinds.Array || t.ElementType.Kind != cpp.TypeKinds.Primitive {
+				return 0
+			}
+			if e := t.ElementType.Wire.String(); e != "float" && e != "double" {
+				return 0
+			}
+			return o.SimdAlignment
+		},
+		"EnvelopeType": func() string {
+			if o.StoragePolicy != "" {
+				return o.StoragePolicy
+			}
+			return "::fidl::Envelope<void>"
+		},
+		// TagCheck is the statement asserting, in the getter |accessor| of
+		// |member|, that the union holds the member with |ordinal|.
+		"TagCheck": func(ordinal interface{}, accessor string, member string) string {
+			cond := fmt.Sprintf("ordinal_ == %s", ordinal)
+			msg := fmt.Sprintf("%s() called on a union not holding |%s|", accessor, member)
+			if o.AssertMacro != "" {
+				return fmt.Sprintf("static_cast<void>(caller_file);\n"+
+					"    static_cast<void>(caller_line);\n"+
+					"    %s(%s && %q);", o.AssertMacro, cond, msg)
+			}
+			return fmt.Sprintf("ZX_ASSERT_MSG(%s, \"%%s:%%d: %s\",\n"+
+				"                  caller_file, caller_line);", cond, msg)
+		},
+		// BoundsCheck is the statement asserting, in the getter |accessor| of
+		// |member|, that the member of type |typ| is within the bounds of the
+		// message being read.
+		"BoundsCheck": func(typ cpp.Type, accessor string, member string) string {
+			cond := fmt.Sprintf("::fidl::HardenedMessageBounds::Contains(envelope_.data.get(), sizeof(%s))", typ)
+			msg := fmt.Sprintf("%s() found |%s| outside of the message", accessor, member)
+			if o.AssertMacro != "" {
+				return fmt.Sprintf("%s(%s && %q);", o.AssertMacro, cond, msg)
+			}
+			return fmt.Sprintf("ZX_ASSERT_MSG(%s,\n"+
+				"                  \"%%s:%%d: %s\", caller_file, caller_line);", cond, msg)
+		},
+		"UnionConversions": func(u cpp.Union) []cpp.UnionConversion {
+			var conversions []cpp.UnionConversion
+			for _, c := range o.UnionConversions {
+				if fidlgen.ParseCompoundIdentifier(fidlgen.EncodedCompoundIdentifier(u.TypeName)).Name == c.Source {
+					conversions = append(conversions, c)
+				}
+			}
+			return conversions
+		},
+	}
+}
+
 type TypedArgument struct {
 	ArgumentName  string
 	ArgumentValue string
@@ -82,6 +353,11 @@ func renderParams(format formatParam, list interface{}) string {
 	return buf.String()
 }
 
+// param renders the definition of a parameter of type |t|. Unions are taken
+// by value: they only refer to their out-of-line member, which encoding
+// copies into the request buffer, so a union built on any arena can be passed
+// as is. An additional |T&&| overload would be ambiguous with the by-value one
+// and is not needed to avoid rebuilding a union.
 func param(n string, t cpp.Type) string {
 	if t.Kind == cpp.TypeKinds.Array || t.Kind == cpp.TypeKinds.Struct {
 		if !t.Nullable {
@@ -164,8 +440,357 @@ func closeHandles(argumentName string, argumentValue string, argumentType cpp.Ty
 	}
 }
 
+// structurallyEqual renders statements which return false from the enclosing
+// function unless |lhs| and |rhs|, of type |argumentType|, are structurally
+// equal. Handles are compared by presence rather than by value.
+func structurallyEqual(lhs string, rhs string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.Handle, cpp.TypeKinds.Request, cpp.TypeKinds.Protocol:
+		return fmt.Sprintf("if (%s.is_valid() != %s.is_valid()) { return false; }", lhs, rhs)
+	case cpp.TypeKinds.String:
+		return fmt.Sprintf("if (%s.get() != %s.get()) { return false; }", lhs, rhs)
+	case cpp.TypeKinds.Array:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("for (size_t %s = 0; %s < %s.size(); ++%s) {\n", i, i, lhs, i))
+		buf.WriteString(structurallyEqual(lhs+"["+i+"]", rhs+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		return buf.String()
+	case cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("if (%s.count() != %s.count()) { return false; }\n", lhs, rhs))
+		buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s.count(); ++%s) {\n", i, i, lhs, i))
+		buf.WriteString(structurallyEqual(lhs+"["+i+"]", rhs+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		return buf.String()
+	case cpp.TypeKinds.Struct, cpp.TypeKinds.Table, cpp.TypeKinds.Union:
+		if argumentType.WirePointer {
+			return fmt.Sprintf("if ((%s == nullptr) != (%s == nullptr)) { return false; }\n"+
+				"if (%s != nullptr && !StructurallyEqual(*%s, *%s)) { return false; }",
+				lhs, rhs, lhs, lhs, rhs)
+		}
+		return fmt.Sprintf("if (!StructurallyEqual(%s, %s)) { return false; }", lhs, rhs)
+	default:
+		return fmt.Sprintf("if (!(%s == %s)) { return false; }", lhs, rhs)
+	}
+}
+
+// lessThan renders statements which return whether |lhs| orders before |rhs|,
+// both of type |argumentType|, when they differ, and fall through otherwise.
+// Strings and vectors are ordered lexicographically, and absent values order
+// before present ones.
+func lessThan(lhs string, rhs string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.String:
+		return fmt.Sprintf("if (%s.get() != %s.get()) { return %s.get() < %s.get(); }", lhs, rhs, lhs, rhs)
+	case cpp.TypeKinds.Array:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("for (size_t %s = 0; %s < %s.size(); ++%s) {\n", i, i, lhs, i))
+		buf.WriteString(lessThan(lhs+"["+i+"]", rhs+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		return buf.String()
+	case cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s.count() && %s < %s.count(); ++%s) {\n",
+			i, i, lhs, i, rhs, i))
+		buf.WriteString(lessThan(lhs+"["+i+"]", rhs+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}\n")
+		buf.WriteString(fmt.Sprintf("if (%s.count() != %s.count()) { return %s.count() < %s.count(); }",
+			lhs, rhs, lhs, rhs))
+		return buf.String()
+	case cpp.TypeKinds.Struct, cpp.TypeKinds.Table, cpp.TypeKinds.Union:
+		if argumentType.WirePointer {
+			return fmt.Sprintf("if ((%s == nullptr) != (%s == nullptr)) { return %s == nullptr; }\n"+
+				"if (%s != nullptr) {\n"+
+				"if (*%s < *%s) { return true; }\n"+
+				"if (*%s < *%s) { return false; }\n"+
+				"}",
+				lhs, rhs, lhs, lhs, lhs, rhs, rhs, lhs)
+		}
+		return fmt.Sprintf("if (%s < %s) { return true; }\nif (%s < %s) { return false; }", lhs, rhs, rhs, lhs)
+	case cpp.TypeKinds.Bits:
+		return fmt.Sprintf("if (%s != %s) {\n"+
+			"return ::fidl::internal::BitsUnderlyingValue(%s) < ::fidl::internal::BitsUnderlyingValue(%s);\n"+
+			"}", lhs, rhs, lhs, rhs)
+	default:
+		return fmt.Sprintf("if (%s != %s) { return %s < %s; }", lhs, rhs, lhs, rhs)
+	}
+}
+
+// abslHash renders statements which combine |value|, of type |argumentType|,
+// into the Abseil hash state |h|. Struct and table values are not hashed,
+// since they do not provide |AbslHashValue|; this keeps the hash consistent
+// with equality, only less precise.
+func abslHash(value string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.String:
+		return fmt.Sprintf("h = H::combine(std::move(h), std::string_view(%s.data(), %s.size()));", value, value)
+	case cpp.TypeKinds.Array, cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		size := value + ".size()"
+		if argumentType.Kind == cpp.TypeKinds.Vector {
+			size = value + ".count()"
+		}
+		var buf bytes.Buffer
+		if element := abslHash(value+"["+i+"]", *argumentType.ElementType, depth+1); element != "" {
+			buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s; ++%s) {\n", i, i, size, i))
+			buf.WriteString(element)
+			buf.WriteString("\n}\n")
+		}
+		buf.WriteString(fmt.Sprintf("h = H::combine(std::move(h), %s);", size))
+		return buf.String()
+	case cpp.TypeKinds.Struct, cpp.TypeKinds.Table:
+		return ""
+	case cpp.TypeKinds.Union:
+		if argumentType.WirePointer {
+			return fmt.Sprintf("h = H::combine(std::move(h), %s != nullptr);\n"+
+				"if (%s != nullptr) { h = H::combine(std::move(h), *%s); }", value, value, value)
+		}
+		return fmt.Sprintf("h = H::combine(std::move(h), %s);", value)
+	case cpp.TypeKinds.Bits:
+		return fmt.Sprintf("h = H::combine(std::move(h), ::fidl::internal::BitsUnderlyingValue(%s));", value)
+	default:
+		return fmt.Sprintf("h = H::combine(std::move(h), %s);", value)
+	}
+}
+
+// outOfLineBytes renders statements which add the size of the out-of-line
+// data that |value|, of type |argumentType|, refers to into |total|. Only
+// strings and vectors are traversed: struct, table and union values only count
+// their own objects when they are out-of-line.
+func outOfLineBytes(total string, value string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.String:
+		return fmt.Sprintf("%s += FIDL_ALIGN(%s.size());", total, value)
+	case cpp.TypeKinds.Array, cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		size := value + ".size()"
+		if argumentType.Kind == cpp.TypeKinds.Vector {
+			size = value + ".count()"
+		}
+		var buf bytes.Buffer
+		if argumentType.Kind == cpp.TypeKinds.Vector {
+			buf.WriteString(fmt.Sprintf("%s += FIDL_ALIGN(%s * sizeof(%s));", total, size, argumentType.ElementType))
+		}
+		if element := outOfLineBytes(total, value+"["+i+"]", *argumentType.ElementType, depth+1); element != "" {
+			if buf.Len() != 0 {
+				buf.WriteString("\n")
+			}
+			buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s; ++%s) {\n", i, i, size, i))
+			buf.WriteString(element)
+			buf.WriteString("\n}")
+		}
+		return buf.String()
+	case cpp.TypeKinds.Struct, cpp.TypeKinds.Table, cpp.TypeKinds.Union:
+		if argumentType.WirePointer {
+			return fmt.Sprintf("if (%s != nullptr) { %s += FIDL_ALIGN(sizeof(*%s)); }", value, total, value)
+		}
+		return ""
+	default:
+		return ""
+	}
+}
+
+// cloneValue renders statements which copy |src|, of type |argumentType|,
+// into |dst|, allocating its out-of-line data from |allocator|. Structs,
+// tables and unions are copied by their Clone method.
+func cloneValue(dst string, src string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.String:
+		return fmt.Sprintf("%s = ::fidl::StringView(allocator, %s.get());", dst, src)
+	case cpp.TypeKinds.Array:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("for (size_t %s = 0; %s < %s.size(); ++%s) {\n", i, i, src, i))
+		buf.WriteString(cloneValue(dst+"["+i+"]", src+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		return buf.String()
+	case cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("%s = %s(allocator, %s.count());\n", dst, argumentType, src))
+		buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s.count(); ++%s) {\n", i, i, src, i))
+		buf.WriteString(cloneValue(dst+"["+i+"]", src+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		return buf.String()
+	case cpp.TypeKinds.Struct, cpp.TypeKinds.Table, cpp.TypeKinds.Union:
+		if argumentType.WirePointer {
+			return fmt.Sprintf("if (%s != nullptr) { %s = %s(allocator, %s->Clone(allocator)); }",
+				src, dst, argumentType, src)
+		}
+		return fmt.Sprintf("%s = %s.Clone(allocator);", dst, src)
+	default:
+		return fmt.Sprintf("%s = %s;", dst, src)
+	}
+}
+
+// naturalFromWire renders statements which convert |src|, a wire value of type
+// |argumentType|, to its natural variant type in |dst|, copying out-of-line
+// data and moving handles.
+func naturalFromWire(dst string, src string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.Handle, cpp.TypeKinds.Request, cpp.TypeKinds.Protocol:
+		return fmt.Sprintf("%s = std::move(%s);", dst, src)
+	case cpp.TypeKinds.String:
+		if argumentType.Nullable {
+			return fmt.Sprintf("if (!%s.is_null()) { %s = std::string(%s.data(), %s.size()); }", src, dst, src, src)
+		}
+		return fmt.Sprintf("%s = std::string(%s.data(), %s.size());", dst, src, src)
+	case cpp.TypeKinds.Array:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("for (size_t %s = 0; %s < %s.size(); ++%s) {\n", i, i, src, i))
+		buf.WriteString(naturalFromWire(dst+"["+i+"]", src+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		return buf.String()
+	case cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		if argumentType.Nullable {
+			buf.WriteString(fmt.Sprintf("if (!%s.is_null()) {\n%s.emplace();\n", src, dst))
+			dst = "(*" + dst + ")"
+		}
+		buf.WriteString(fmt.Sprintf("%s.resize(%s.count());\n", dst, src))
+		buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s.count(); ++%s) {\n", i, i, src, i))
+		buf.WriteString(naturalFromWire(dst+"["+i+"]", src+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		if argumentType.Nullable {
+			buf.WriteString("\n}")
+		}
+		return buf.String()
+	case cpp.TypeKinds.Union:
+		if argumentType.IsResource {
+			return fmt.Sprintf("%s = std::decay_t<decltype(%s)>::FromWire(std::move(%s));", dst, dst, src)
+		}
+		return fmt.Sprintf("%s = std::decay_t<decltype(%s)>::FromWire(%s);", dst, dst, src)
+	default:
+		return fmt.Sprintf("%s = %s;", dst, src)
+	}
+}
+
+// naturalToWire renders statements which convert |src|, a natural variant
+// value, to the wire type |argumentType| in |dst|, allocating out-of-line data
+// from |allocator| and moving handles.
+func naturalToWire(dst string, src string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.Handle, cpp.TypeKinds.Request, cpp.TypeKinds.Protocol:
+		return fmt.Sprintf("%s = std::move(%s);", dst, src)
+	case cpp.TypeKinds.String:
+		if argumentType.Nullable {
+			return fmt.Sprintf("if (%s.has_value()) { %s = ::fidl::StringView(allocator, *%s); }", src, dst, src)
+		}
+		return fmt.Sprintf("%s = ::fidl::StringView(allocator, %s);", dst, src)
+	case cpp.TypeKinds.Array:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("for (size_t %s = 0; %s < %s.size(); ++%s) {\n", i, i, src, i))
+		buf.WriteString(naturalToWire(dst+"["+i+"]", src+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		return buf.String()
+	case cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		var buf bytes.Buffer
+		if argumentType.Nullable {
+			buf.WriteString(fmt.Sprintf("if (%s.has_value()) {\n", src))
+			src = "(*" + src + ")"
+		}
+		buf.WriteString(fmt.Sprintf("%s = %s(allocator, %s.size());\n", dst, argumentType, src))
+		buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s.size(); ++%s) {\n", i, i, src, i))
+		buf.WriteString(naturalToWire(dst+"["+i+"]", src+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}")
+		if argumentType.Nullable {
+			buf.WriteString("\n}")
+		}
+		return buf.String()
+	case cpp.TypeKinds.Union:
+		if argumentType.IsResource {
+			return fmt.Sprintf("%s = std::move(%s).ToWire(allocator);", dst, src)
+		}
+		return fmt.Sprintf("%s = %s.ToWire(allocator);", dst, src)
+	default:
+		return fmt.Sprintf("%s = %s;", dst, src)
+	}
+}
+
+// fidlText renders statements which append the FIDL text representation of
+// |value|, of type |argumentType|, to the std::string |out|.
+func fidlText(value string, argumentType cpp.Type, depth int) string {
+	switch argumentType.Kind {
+	case cpp.TypeKinds.Handle, cpp.TypeKinds.Request, cpp.TypeKinds.Protocol:
+		return fmt.Sprintf("out += %s.is_valid() ? \"<handle>\" : \"null\";", value)
+	case cpp.TypeKinds.String:
+		return fmt.Sprintf("::fidl::internal::AppendFidlTextString(out, %s.get());", value)
+	case cpp.TypeKinds.Array, cpp.TypeKinds.Vector:
+		i := fmt.Sprintf("i%d", depth)
+		size := value + ".size()"
+		if argumentType.Kind == cpp.TypeKinds.Vector {
+			size = value + ".count()"
+		}
+		var buf bytes.Buffer
+		buf.WriteString("out += \"[\";\n")
+		buf.WriteString(fmt.Sprintf("for (uint64_t %s = 0; %s < %s; ++%s) {\n", i, i, size, i))
+		buf.WriteString(fmt.Sprintf("if (%s != 0) { out += \", \"; }\n", i))
+		buf.WriteString(fidlText(value+"["+i+"]", *argumentType.ElementType, depth+1))
+		buf.WriteString("\n}\nout += \"]\";")
+		return buf.String()
+	case cpp.TypeKinds.Struct, cpp.TypeKinds.Table, cpp.TypeKinds.Union:
+		if argumentType.WirePointer {
+			return fmt.Sprintf("out += %s == nullptr ? \"null\" : ToFidlText(*%s);", value, value)
+		}
+		return fmt.Sprintf("out += ToFidlText(%s);", value)
+	case cpp.TypeKinds.Bits:
+		return fmt.Sprintf("out += std::to_string(::fidl::internal::BitsUnderlyingValue(%s));", value)
+	case cpp.TypeKinds.Enum:
+		return fmt.Sprintf("out += std::to_string(static_cast<std::underlying_type_t<%s>>(%s));",
+			argumentType, value)
+	default:
+		if argumentType.String() == "bool" {
+			return fmt.Sprintf("out += %s ? \"true\" : \"false\";", value)
+		}
+		return fmt.Sprintf("out += std::to_string(%s);", value)
+	}
+}
+
+// unions returns the unions among |decls|, in declaration order.
+func unions(decls []cpp.Kinded) []cpp.Union {
+	var unions []cpp.Union
+	for _, decl := range decls {
+		if decl.Kind() == cpp.Kinds.Union {
+			unions = append(unions, decl.(cpp.Union))
+		}
+	}
+	return unions
+}
+
+// hasContiguousBytes returns whether a value of type |t| is entirely held in
+// its own bytes, with no out-of-line data, handles or padding.
+func hasContiguousBytes(t cpp.Type) bool {
+	switch t.Kind {
+	case cpp.TypeKinds.Primitive, cpp.TypeKinds.Bits, cpp.TypeKinds.Enum:
+		return true
+	case cpp.TypeKinds.Array:
+		return hasContiguousBytes(*t.ElementType)
+	}
+	return false
+}
+
+// outOfLineBound describes a bound on out-of-line bytes from the type shape,
+// in which unbounded sizes saturate at the maximum uint32.
+func outOfLineBound(n int) string {
+	if n >= math.MaxUint32 {
+		return "unbounded"
+	}
+	return fmt.Sprintf("at most %d bytes", n)
+}
+
 // These are the helper functions we inject for use by the templates.
 var utilityFuncs = template.FuncMap{
+	"Unions":             unions,
+	"HasContiguousBytes": hasContiguousBytes,
+	"OutOfLineBound":     outOfLineBound,
 	"SyncCallTotalStackSize": func(m cpp.Method) int {
 		totalSize := 0
 		if m.Request.ClientAllocation.IsStack {
@@ -182,6 +807,30 @@ var utilityFuncs = template.FuncMap{
 		n, t := member.NameAndType()
 		return closeHandles(n, n, t, t.WirePointer, t.WirePointer, access, mutableAccess)
 	},
+	"StructurallyEqual": func(lhs string, rhs string, t cpp.Type) string {
+		return structurallyEqual(lhs, rhs, t, 0)
+	},
+	"LessThan": func(lhs string, rhs string, t cpp.Type) string {
+		return lessThan(lhs, rhs, t, 0)
+	},
+	"AbslHashCombine": func(value string, t cpp.Type) string {
+		return abslHash(value, t, 0)
+	},
+	"OutOfLineBytes": func(total string, value string, t cpp.Type) string {
+		return outOfLineBytes(total, value, t, 0)
+	},
+	"CloneValue": func(dst string, src string, t cpp.Type) string {
+		return cloneValue(dst, src, t, 0)
+	},
+	"NaturalFromWire": func(dst string, src string, t cpp.Type) string {
+		return naturalFromWire(dst, src, t, 0)
+	},
+	"NaturalToWire": func(dst string, src string, t cpp.Type) string {
+		return naturalToWire(dst, src, t, 0)
+	},
+	"FidlText": func(value string, t cpp.Type) string {
+		return fidlText(value, t, 0)
+	},
 	"RenderParams": func(params ...interface{}) string {
 		return renderParams(param, params)
 	},
@@ -203,11 +852,13 @@ var utilityFuncs = template.FuncMap{
 	},
 }
 
-func NewGenerator() *Generator {
+func NewGenerator(opts Options) *Generator {
 	tmpls := template.New("LLCPPTemplates").
-		Funcs(cpp.MergeFuncMaps(cpp.CommonTemplateFuncs, utilityFuncs))
+		Funcs(cpp.MergeFuncMaps(cpp.CommonTemplateFuncs, utilityFuncs, opts.templateFuncs()))
 	templates := []string{
+		fileCompatTestTmpl,
 		fileHeaderTmpl,
+		fileModuleTmpl,
 		fileSourceTmpl,
 		fragmentBitsTmpl,
 		fragmentClientAsyncMethodsTmpl,
@@ -215,6 +866,7 @@ func NewGenerator() *Generator {
 		fragmentConstTmpl,
 		fragmentEnumTmpl,
 		fragmentEventSenderTmpl,
+		fragmentFidlTextTmpl,
 		fragmentMethodCompleterBaseTmpl,
 		fragmentMethodRequestTmpl,
 		fragmentMethodResponseContextTmpl,
@@ -235,6 +887,7 @@ func NewGenerator() *Generator {
 		fragmentSyncRequestCallerAllocateTmpl,
 		fragmentTableTmpl,
 		fragmentUnionTmpl,
+		fragmentUnionNaturalTmpl,
 		testBaseTmpl,
 	}
 	for _, t := range templates {
@@ -279,6 +932,14 @@ func (gen *Generator) generateTestBase(wr io.Writer, tree cpp.Root) error {
 	return gen.tmpls.ExecuteTemplate(wr, "TestBase", tree)
 }
 
+func (gen *Generator) generateCompatTest(wr io.Writer, tree cpp.Root) error {
+	return gen.tmpls.ExecuteTemplate(wr, "CompatTest", tree)
+}
+
+func (gen *Generator) generateModuleInterface(wr io.Writer, tree cpp.Root) error {
+	return gen.tmpls.ExecuteTemplate(wr, "ModuleInterface", tree)
+}
+
 // GenerateHeader generates the LLCPP bindings header, and writes it into
 // the target filename.
 func (gen *Generator) GenerateHeader(tree cpp.Root, filename, clangFormatPath string) error {
@@ -302,3 +963,67 @@ func (gen *Generator) GenerateTestBase(tree cpp.Root, filename, clangFormatPath
 		return gen.generateTestBase(wr, tree)
 	})
 }
+
+// GenerateModuleInterface generates a C++20 module interface unit exporting
+// the wire domain objects of the library, and writes it into the target
+// filename.
+func (gen *Generator) GenerateModuleInterface(tree cpp.Root, filename, clangFormatPath string) error {
+	return generateFile(filename, clangFormatPath, func(wr io.Writer) error {
+		return gen.generateModuleInterface(wr, tree)
+	})
+}
+
+// GenerateCompatTest generates a test checking the union member ordinals of
+// the library against their current values, and writes it into the target
+// filename.
+func (gen *Generator) GenerateCompatTest(tree cpp.Root, filename, clangFormatPath string) error {
+	return generateFile(filename, clangFormatPath, func(wr io.Writer) error {
+		return gen.generateCompatTest(wr, tree)
+	})
+}
+
+// unionDocs is the documentation of a union in the sidecar file written by
+// GenerateUnionDocs.
+type unionDocs struct {
+	Doc     string            `json:"doc,omitempty"`
+	Members map[string]string `json:"members"`
+}
+
+// docText joins doc comment lines, dropping the space which usually follows
+// the comment marker.
+func docText(a cpp.Attributes) string {
+	lines := a.DocComments()
+	for i, l := range lines {
+		lines[i] = strings.TrimPrefix(l, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// GenerateUnionDocs writes the doc comments of the unions of the library and
+// of their members to the target filename, as JSON keyed by FIDL type name
+// and then by member name, so that documentation tools need not parse C++.
+func (gen *Generator) GenerateUnionDocs(tree cpp.Root, filename string) error {
+	docs := make(map[string]unionDocs)
+	for _, u := range unions(tree.Decls) {
+		d := unionDocs{Doc: docText(u.Attributes), Members: make(map[string]string)}
+		for _, m := range u.Members {
+			if text := docText(m.Attributes); text != "" {
+				d.Members[m.Name()] = text
+			}
+		}
+		docs[u.TypeName] = d
+	}
+	contents, err := json.MarshalIndent(docs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := fidlgen.NewLazyWriter(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(contents, '\n')); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const fileCompatTestTmpl = `
+{{- define "CompatTest" -}}
+{{- UseWire -}}
+// WARNING: This file is machine generated by fidlgen.
+
+// Checks the ordinals of the union members of the library against their
+// values when this file was generated. Check it in instead of generating it
+// during the build, so that changing an ordinal fails the test until the file
+// is deliberately regenerated.
+//
+// Also checks that moved-from unions are left absent, with an invalid tag and
+// an empty envelope, whose data pointer is poisoned in debug builds.
+
+#include <{{ .PrimaryHeader }}>
+#include <lib/fidl/llcpp/fidl_allocator.h>
+
+#include <gtest/gtest.h>
+{{- range $union := Unions .Decls }}
+{{ if .IsResourceType }}
+{{- IfdefFuchsia -}}
+{{- end }}
+TEST({{ range $.Library }}{{ . }}_{{ end }}UnionOrdinals, {{ .Name }}) {
+  {{- range .Members }}
+  EXPECT_EQ({{ $union }}::TagName(static_cast<{{ $union.TagEnum }}>({{ .Ordinal }}u)), "{{ .Name }}");
+  {{- end }}
+}
+{{- with $member := index .Members 0 }}
+{{- if not (or .IsExperimental .Validator) }}
+
+TEST({{ range $.Library }}{{ . }}_{{ end }}UnionMoves, {{ $union.Name }}) {
+  auto expect_absent = [](const {{ $union }}& value) {
+    EXPECT_TRUE(value.has_invalid_tag());
+    const fidl_envelope_t& envelope = reinterpret_cast<const fidl_xunion_t&>(value).envelope;
+    EXPECT_EQ(envelope.num_bytes, 0u);
+    EXPECT_EQ(envelope.num_handles, 0u);
+#ifdef NDEBUG
+    EXPECT_EQ(envelope.data, nullptr);
+#else
+    EXPECT_EQ(envelope.data, reinterpret_cast<void*>(static_cast<uintptr_t>(0xfdfdfdfdfdfdfdfd)));
+#endif
+  };
+  ::fidl::FidlAllocator<> allocator;
+  {{ $union }} value;
+  value.set_{{ .Name }}(allocator);
+
+  {{ $union }} moved(std::move(value));
+  expect_absent(value);  // NOLINT(bugprone-use-after-move)
+  EXPECT_TRUE(moved.is_{{ .Name }}());
+
+  {{ $union }} assigned;
+  assigned = std::move(moved);
+  expect_absent(moved);  // NOLINT(bugprone-use-after-move)
+  EXPECT_TRUE(assigned.is_{{ .Name }}());
+}
+{{- end }}
+{{- end }}
+{{- if .IsResourceType }}
+{{- EndifFuchsia -}}
+{{- end }}
+{{- end }}
+{{ end }}
+`
@@ -7,18 +7,62 @@ package codegen
 const fileHeaderTmpl = `
 {{- define "Header" -}}
 {{- UseWire -}}
+{{- $unions := Unions .Decls }}
+{{- $protocols := false }}
+{{- range .Decls }}{{ if Eq .Kind Kinds.Protocol }}{{ $protocols = true }}{{ end }}{{ end -}}
 // WARNING: This file is machine generated by fidlgen.
 
 #pragma once
 
 #include <algorithm>
+{{- if and $unions TypeErasedSet }}
+#include <any>
+{{- end }}
+{{- if or $unions $protocols }}
+#include <array>
+{{- end }}
+{{- if AccessCoverage }}
+#include <atomic>
+{{- end }}
 #include <cstddef>
+{{- if $unions }}
+#include <functional>
+{{- end }}
+{{- if and $unions Coalesce }}
+#include <initializer_list>
+{{- end }}
+{{- if or ArenaBackedUnions DeepCopy }}
+#include <memory>
+{{- end }}
+{{- if $unions }}
+#include <new>
+{{- end }}
+{{- if or AccessCoverage LenientGetters }}
+#include <cstdio>
+{{- end }}
+{{- if or ZeroUnionPadding DeepCopy }}
+#include <cstring>
+{{- end }}
+{{- if or EmitFidlText NaturalVariantUnions }}
+#include <string>
+{{- end }}
+{{- if $unions }}
+#include <string_view>
+#include <type_traits>
+#include <utility>
+{{- end }}
 #include <variant>
+{{- if or (and $unions UnionEncode) NaturalVariantUnions }}
+#include <vector>
+{{- end }}
 
 #include <lib/fidl/internal.h>
 #include <lib/fidl/llcpp/array.h>
 #include <lib/fidl/llcpp/coding.h>
 #include <lib/fidl/llcpp/envelope.h>
+{{- if or ArenaBackedUnions DeepCopy }}
+#include <lib/fidl/llcpp/fidl_allocator.h>
+{{- end }}
 #include <lib/fidl/llcpp/message.h>
 #include <lib/fidl/llcpp/message_storage.h>
 #include <lib/fidl/llcpp/object_view.h>
@@ -28,7 +72,13 @@ const fileHeaderTmpl = `
 #include <lib/fidl/llcpp/vector_view.h>
 #include <lib/fidl/llcpp/wire_messaging.h>
 #include <lib/fit/function.h>
+{{- if FitResultGetters }}
+#include <lib/fit/result.h>
+{{- end }}
 #include <lib/stdcompat/optional.h>
+{{- if $unions }}
+#include <lib/stdcompat/span.h>
+{{- end }}
 {{- IfdefFuchsia -}}
 #include <lib/fidl/llcpp/client_end.h>
 #include <lib/fidl/llcpp/client.h>
@@ -39,6 +89,9 @@ const fileHeaderTmpl = `
 #include <lib/fidl/llcpp/sync_call.h>
 #include <lib/fidl/llcpp/transaction.h>
 #include <lib/fidl/txn_header.h>
+{{- if TraceHandles }}
+#include <lib/trace/event.h>
+{{- end }}
 {{ range .HandleTypes -}}
 #include <lib/zx/{{ . }}.h>
 {{ end -}}
@@ -51,6 +104,31 @@ const fileHeaderTmpl = `
 #include <{{ . }}/{{ $root.IncludeStem }}.h>
 {{ end -}}
 {{ end -}}
+{{ template "BitsHelpers" }}
+{{- if $unions }}
+{{ template "UnionHelpers" }}
+{{- end }}
+{{- if EmitFidlText }}
+{{ template "FidlTextHelpers" }}
+{{- end }}
+{{- if Lifetimebound }}
+
+#ifndef FIDL_LIFETIMEBOUND
+#if __has_cpp_attribute(clang::lifetimebound)
+#define FIDL_LIFETIMEBOUND [[clang::lifetimebound]]
+#else
+#define FIDL_LIFETIMEBOUND
+#endif
+#endif  // FIDL_LIFETIMEBOUND
+{{- end }}
+{{- if DestructorHook }}
+{{ "" }}
+{{- IfdefFuchsia -}}
+// Called with the FIDL type name of each resource union whose handles are
+// about to be closed. Define it to audit handle lifetimes.
+extern "C" __attribute__((weak)) void OnUnionDestroyed(const char* fidl_type_name);
+{{- EndifFuchsia -}}
+{{- end }}
 
 {{- range .Decls }}
 {{- if Eq .Kind Kinds.Bits }}{{ template "BitsForwardDeclaration" . }}{{- end }}
@@ -82,6 +160,18 @@ const fileHeaderTmpl = `
 {{- if Eq .Kind Kinds.Service }}{{ template "ServiceDeclaration" . }}{{- end }}
 {{- if Eq .Kind Kinds.Struct }}{{ template "StructDeclaration" . }}{{- end }}
 {{- end }}
+
+{{- if UnionIntrospection }}
+{{- template "UnionRegistryDeclaration" .Decls }}
+{{- end }}
+
+{{- /* The natural unions hold their members by value, so they come after
+    all the wire types are complete. */}}
+{{- if NaturalVariantUnions }}
+{{- range .Decls }}
+{{- if and (Eq .Kind Kinds.Union) .HasNaturalVariant }}{{ template "UnionNaturalDeclaration" . }}{{- end }}
+{{- end }}
+{{- end }}
 {{ "" }}
 
 {{ EnsureNamespace "fidl" }}
@@ -98,6 +188,16 @@ const fileHeaderTmpl = `
 {{- if Eq .Kind Kinds.Enum }}{{ template "EnumTraits" . }}{{- end }}
 {{- end }}
 
+{{- /* Lets unions be used in structured bindings. */}}
+{{- if StructuredBindings }}
+{{- range .Decls }}
+{{- if Eq .Kind Kinds.Union }}
+{{ EnsureNamespace "std" }}
+{{- template "UnionTupleTraits" . }}
+{{- end }}
+{{- end }}
+{{- end }}
+
 {{- range .Decls }}
     {{- if Eq .Kind Kinds.Protocol }}{{ $protocol := . }}
     {{- range $transport, $_ := .Transports }}{{- if eq $transport "Channel" -}}
@@ -0,0 +1,39 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const fileModuleTmpl = `
+{{- define "ModuleInterface" -}}
+{{- UseWire -}}
+// WARNING: This file is machine generated by fidlgen.
+
+// A C++20 module interface unit exporting the wire domain objects of the
+// library. The declarations come from the generated header, which is included
+// in the global module fragment.
+module;
+
+#include <{{ .PrimaryHeader }}>
+
+export module {{ range $i, $part := .Library }}{{ if $i }}.{{ end }}{{ $part }}{{ end }}.wire;
+{{- range .Decls }}
+{{- if or (Eq .Kind Kinds.Bits) (Eq .Kind Kinds.Enum) }}
+
+export namespace {{ .Wire.Namespace.NoLeading }} {
+using {{ .Wire }};
+}
+{{- else if or (Eq .Kind Kinds.Struct) (Eq .Kind Kinds.Table) (Eq .Kind Kinds.Union) }}
+{{ if .IsResourceType }}
+{{- IfdefFuchsia -}}
+{{- end }}
+export namespace {{ .Wire.Namespace.NoLeading }} {
+using {{ .Wire }};
+}
+{{- if .IsResourceType }}
+{{- EndifFuchsia -}}
+{{- end }}
+{{- end }}
+{{- end }}
+{{ end }}
+`
@@ -26,6 +26,9 @@ const fileSourceTmpl = `
 {{- if Eq .Kind Kinds.Union }}{{ template "UnionDefinition" . }}{{- end }}
 {{- if Eq .Kind Kinds.Table }}{{ template "TableDefinition" . }}{{- end }}
 {{- end }}
+{{- if UnionIntrospection }}
+{{- template "UnionRegistryDefinition" .Decls }}
+{{- end }}
 {{ "" }}
 
 {{ EndOfFile }}
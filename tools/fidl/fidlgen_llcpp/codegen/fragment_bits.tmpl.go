@@ -5,6 +5,32 @@
 package codegen
 
 const fragmentBitsTmpl = `
+{{- define "BitsHelpers" }}
+{{- /* These are shared by the headers of all libraries. */}}
+#ifndef LIB_FIDL_LLCPP_BITS_HELPERS_
+#define LIB_FIDL_LLCPP_BITS_HELPERS_
+namespace fidl {
+namespace internal {
+
+template <typename F>
+struct BitsArgument;
+template <typename R, typename A>
+struct BitsArgument<R (*)(A)> {
+  using type = A;
+};
+
+// Returns the underlying value of the bits |value|. A plain static_cast may be
+// ambiguous, since bits are also explicitly convertible to bool.
+template <typename Bits>
+constexpr auto BitsUnderlyingValue(const Bits& value) {
+  return static_cast<typename BitsArgument<decltype(&Bits::TruncatingUnknown)>::type>(value);
+}
+
+}  // namespace internal
+}  // namespace fidl
+#endif  // LIB_FIDL_LLCPP_BITS_HELPERS_
+{{- end }}
+
 {{- define "BitsForwardDeclaration" }}
 {{ EnsureNamespace . }}
 {{- .Docs }}
@@ -0,0 +1,31 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const fragmentFidlTextTmpl = `
+{{- define "FidlTextHelpers" }}
+{{- /* These are shared by the headers of all libraries. */}}
+#ifndef LIB_FIDL_LLCPP_FIDL_TEXT_HELPERS_
+#define LIB_FIDL_LLCPP_FIDL_TEXT_HELPERS_
+namespace fidl {
+namespace internal {
+
+// Appends |value| to |out| as a quoted FIDL string literal.
+inline void AppendFidlTextString(std::string& out, std::string_view value) {
+  out += '"';
+  for (char c : value) {
+    if (c == '"' || c == '\\') {
+      out += '\\';
+    }
+    out += c;
+  }
+  out += '"';
+}
+
+}  // namespace internal
+}  // namespace fidl
+#endif  // LIB_FIDL_LLCPP_FIDL_TEXT_HELPERS_
+{{- end }}
+`
@@ -45,7 +45,15 @@ class {{ .Name }} final {
     class {{ .Marker.Self }} final {
       {{ .Marker.Self }}() = delete;
     };
+    static constexpr uint64_t k{{ .Name }}Ordinal = {{ .Ordinal }}lu;
   {{- end }}
+
+  // The ordinals of all methods and events, in declaration order.
+  static constexpr ::std::array<uint64_t, {{ len .Methods }}> kMethodOrdinals = {
+  {{- range .Methods }}
+    k{{ .Name }}Ordinal,
+  {{- end }}
+  };
 };
 
 {{- template "ProtocolDetailsDeclaration" . }}
@@ -36,6 +36,11 @@ struct {{ .Name }} {
   {{- if .IsResourceType }}
 
   void _CloseHandles();
+  {{- else if DeepCopy }}
+
+  // Returns a copy of this struct whose out-of-line data, including that of
+  // nested structs, tables and unions, is allocated from |allocator|.
+  {{ .Name }} Clone(::fidl::AnyAllocator& allocator) const;
   {{- end }}
 
   class UnownedEncodedMessage final {
@@ -131,6 +136,23 @@ struct {{ .Name }} {
     void ReleasePrimaryObject() { ResetBytes(); }
   };
 };
+
+{{- if StructuralComparison }}
+
+// Compares the fields of |lhs| and |rhs| recursively. Handles are compared
+// by presence only, so that values holding different handles compare equal.
+bool StructurallyEqual(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+{{- if not .IsResourceType }}
+
+// Orders structs by the values of their members, in declaration order.
+bool operator<(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+{{- end }}
+{{- end }}
+{{- if EmitFidlText }}
+
+// Renders |value| in the FIDL text format, for golden tests.
+std::string ToFidlText(const {{ .Name }}& value);
+{{- end }}
 {{- if .IsResourceType }}
 {{- EndifFuchsia -}}
 {{- end }}
@@ -147,6 +169,48 @@ void {{ . }}::_CloseHandles() {
     {{- CloseHandles . false false }}
   {{- end }}
 }
+{{- end }}
+{{- if StructuralComparison }}
+
+bool {{ .Namespace }}::StructurallyEqual(const {{ . }}& lhs, const {{ . }}& rhs) {
+  {{- range .Members }}
+  {{ StructurallyEqual (printf "lhs.%s" .Name) (printf "rhs.%s" .Name) .Type }}
+  {{- end }}
+  return true;
+}
+{{- if not .IsResourceType }}
+
+bool {{ .Namespace }}::operator<(const {{ . }}& lhs, const {{ . }}& rhs) {
+  {{- range .Members }}
+  {{ LessThan (printf "lhs.%s" .Name) (printf "rhs.%s" .Name) .Type }}
+  {{- end }}
+  return false;
+}
+{{- end }}
+{{- end }}
+{{- if and DeepCopy (not .IsResourceType) }}
+
+auto {{ . }}::Clone([[maybe_unused]] ::fidl::AnyAllocator& allocator) const -> {{ . }} {
+  {{ . }} result;
+  {{- range .Members }}
+  {{ CloneValue (printf "result.%s" .Name) (printf "this->%s" .Name) .Type }}
+  {{- end }}
+  return result;
+}
+{{- end }}
+{{- if EmitFidlText }}
+
+auto {{ .Namespace }}::ToFidlText(const {{ . }}& value) -> std::string {
+  std::string out = "{{ .Name }} {";
+  {{- range $index, $member := .Members }}
+  out += "{{ if $index }},{{ end }} {{ .Name }}: ";
+  {{ FidlText (printf "value.%s" .Name) .Type }}
+  {{- end }}
+  out += " }";
+  return out;
+}
+{{- end }}
+{{- if .IsResourceType }}
 {{- EndifFuchsia -}}
 {{- end }}
 {{- end }}
@@ -63,6 +63,22 @@ public:
   }
   {{- end }}
 
+  // Passed to the visitor of |ForEachSetField| for set fields that are
+  // unknown to this version of the table.
+  struct UnknownField {};
+
+  // Invokes |visitor(ordinal, value)| for each set field, in ordinal order.
+  // Absent fields are skipped, and unknown fields are visited with an
+  // |UnknownField| value.
+  template <typename Visitor>
+  void ForEachSetField(Visitor&& visitor) {
+    ForEachSetFieldImpl(*this, std::forward<Visitor>(visitor));
+  }
+  template <typename Visitor>
+  void ForEachSetField(Visitor&& visitor) const {
+    ForEachSetFieldImpl(*this, std::forward<Visitor>(visitor));
+  }
+
   {{ .Name }}() = default;
   explicit {{ .Name }}(::fidl::AnyAllocator& allocator)
       : frame_ptr_(::fidl::ObjectView<Frame_>(allocator)) {}
@@ -96,6 +112,12 @@ public:
   {{- if .IsResourceType }}
 
   void _CloseHandles();
+  {{- else if DeepCopy }}
+
+  // Returns a copy of this table in a new frame, whose fields, including their
+  // out-of-line data, are allocated from |allocator|. Unknown fields are
+  // dropped.
+  {{ .Name }} Clone(::fidl::AnyAllocator& allocator) const;
   {{- end }}
 
   class UnownedEncodedMessage final {
@@ -221,10 +243,49 @@ public:
   };
 
  private:
+  template <typename Self, typename Visitor>
+  static void ForEachSetFieldImpl(Self& self, Visitor&& visitor) {
+    const auto* envelopes =
+        reinterpret_cast<const ::fidl::Envelope<void>*>(self.frame_ptr_.get());
+    for (uint64_t ordinal = 1; ordinal <= self.max_ordinal_; ++ordinal) {
+      if (envelopes[ordinal - 1].data == nullptr) {
+        continue;
+      }
+      switch (ordinal) {
+      {{- range .Members }}
+        case {{ .Ordinal }}:
+          visitor(ordinal, self.{{ .Name }}());
+          break;
+      {{- end }}
+        default:
+          visitor(ordinal, UnknownField{});
+          break;
+      }
+    }
+  }
+
   uint64_t max_ordinal_ = 0;
   ::fidl::ObjectView<Frame_> frame_ptr_;
 };
 
+{{- if StructuralComparison }}
+
+// Compares the set fields of |lhs| and |rhs| recursively. Handles are compared
+// by presence only, so that values holding different handles compare equal.
+bool StructurallyEqual(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+{{- if not .IsResourceType }}
+
+// Orders tables by their fields in ordinal order, with absent fields ordering
+// before present ones.
+bool operator<(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+{{- end }}
+{{- end }}
+{{- if EmitFidlText }}
+
+// Renders |value| in the FIDL text format, for golden tests.
+std::string ToFidlText(const {{ .Name }}& value);
+{{- end }}
+
 {{- if .IsResourceType }}
 {{- EndifFuchsia -}}
 {{ end }}
@@ -233,8 +294,8 @@ public:
 {{/* TODO(fxbug.dev/36441): Remove __Fuchsia__ ifdefs once we have non-Fuchsia
      emulated handles for C++. */}}
 {{- define "TableDefinition" }}
-{{ if .IsResourceType }}
 {{ EnsureNamespace "" }}
+{{ if .IsResourceType }}
 {{- IfdefFuchsia -}}
 void {{ . }}::_CloseHandles() {
   {{- range .Members }}
@@ -245,6 +306,67 @@ void {{ . }}::_CloseHandles() {
     {{- end }}
   {{- end }}
 }
+{{- end }}
+{{- if StructuralComparison }}
+
+bool {{ .Namespace }}::StructurallyEqual(const {{ . }}& lhs, const {{ . }}& rhs) {
+  {{- range .Members }}
+  if (lhs.{{ .MethodHasName }}() != rhs.{{ .MethodHasName }}()) {
+    return false;
+  }
+  if (lhs.{{ .MethodHasName }}()) {
+    {{ StructurallyEqual (printf "lhs.%s()" .Name) (printf "rhs.%s()" .Name) .Type }}
+  }
+  {{- end }}
+  return true;
+}
+{{- if not .IsResourceType }}
+
+bool {{ .Namespace }}::operator<(const {{ . }}& lhs, const {{ . }}& rhs) {
+  {{- range .Members }}
+  if (lhs.{{ .MethodHasName }}() != rhs.{{ .MethodHasName }}()) {
+    return rhs.{{ .MethodHasName }}();
+  }
+  if (lhs.{{ .MethodHasName }}()) {
+    {{ LessThan (printf "lhs.%s()" .Name) (printf "rhs.%s()" .Name) .Type }}
+  }
+  {{- end }}
+  return false;
+}
+{{- end }}
+{{- end }}
+{{- if and DeepCopy (not .IsResourceType) }}
+
+auto {{ . }}::Clone(::fidl::AnyAllocator& allocator) const -> {{ . }} {
+  {{ . }} result(allocator);
+  {{- range .Members }}
+  if ({{ .MethodHasName }}()) {
+    ::fidl::ObjectView<{{ .Type }}> value(allocator);
+    {{ CloneValue "(*value)" (printf "this->%s()" .Name) .Type }}
+    result.set_{{ .Name }}(value);
+  }
+  {{- end }}
+  return result;
+}
+{{- end }}
+{{- if EmitFidlText }}
+
+auto {{ .Namespace }}::ToFidlText(const {{ . }}& value) -> std::string {
+  std::string out = "{{ .Name }} {";
+  const char* separator = " ";
+  {{- range .Members }}
+  if (value.{{ .MethodHasName }}()) {
+    out += separator;
+    out += "{{ .Name }}: ";
+    {{ FidlText (printf "value.%s()" .Name) .Type }}
+    separator = ", ";
+  }
+  {{- end }}
+  out += " }";
+  return out;
+}
+{{- end }}
+{{- if .IsResourceType }}
 {{- EndifFuchsia -}}
 {{- end }}
 {{- end }}
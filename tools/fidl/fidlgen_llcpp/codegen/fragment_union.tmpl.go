@@ -5,29 +5,1573 @@
 package codegen
 
 const fragmentUnionTmpl = `
+{{- define "UnionHelpers" }}
+{{- /* These are shared by the headers of all libraries. Those which depend on
+    options have guards of their own, as libraries may be generated with
+    different options. */}}
+{{- if StructuralComparison }}
+#ifndef LIB_FIDL_LLCPP_UNION_DIFF_
+#define LIB_FIDL_LLCPP_UNION_DIFF_
+namespace fidl {
+
+// How a union value differs from another, as reported by the generated
+// Diff() functions.
+struct UnionDiff {
+  // The unions hold different members.
+  bool tag_changed = false;
+  // The unions hold the same member, with structurally different values.
+  bool value_changed = false;
+
+  bool changed() const { return tag_changed || value_changed; }
+};
+
+}  // namespace fidl
+#endif  // LIB_FIDL_LLCPP_UNION_DIFF_
+{{- end }}
+#ifndef LIB_FIDL_LLCPP_UNION_HELPERS_
+#define LIB_FIDL_LLCPP_UNION_HELPERS_
+namespace fidl {
+
+// The bytes the member of a union occupies in its arena, as returned by the
+// generated ReportAllocation() functions.
+struct AllocationReport {
+  // The object of the member.
+  size_t inline_bytes = 0;
+  // The strings and vectors the member refers to.
+  size_t out_of_line_bytes = 0;
+
+  size_t total() const { return inline_bytes + out_of_line_bytes; }
+};
+
+// The wire format that generated unions are encoded in.
+enum class WireFormatVersion {
+  kV1 = 1,
+};
+
+// Whether a |T| may be relocated by copying its bytes to a new address and
+// not running its destructor at the old one, as containers such as
+// folly::fbvector do on growth. Specializations can be forwarded to the trait
+// of such a container.
+template <typename T>
+struct IsRelocatable : public std::is_trivially_copyable<T> {};
+
+// Creates the |CapabilityToken| of the union |T|, which grants access to its
+// members annotated with @requires_cap. It is only declared here: the trusted
+// code that may access those members defines the specialization for |T|, e.g.
+// with a static function returning |T::CapabilityToken()|.
+template <typename T>
+struct CapabilityIssuer;
+
+// The bytes of the message being read on the current thread, for the getters
+// of unions generated with -hardened, which abort if the out-of-line data of
+// the member they return is not within these bounds. Bounds nest, and getters
+// do not check anything outside of the scope of one: create one around the
+// code reading a decoded message, but not around code building unions in an
+// arena.
+class HardenedMessageBounds {
+ public:
+  HardenedMessageBounds(const void* bytes, size_t num_bytes)
+      : begin_(reinterpret_cast<uintptr_t>(bytes)), end_(begin_ + num_bytes), previous_(current_) {
+    current_ = this;
+  }
+  ~HardenedMessageBounds() { current_ = previous_; }
+
+  HardenedMessageBounds(const HardenedMessageBounds&) = delete;
+  HardenedMessageBounds& operator=(const HardenedMessageBounds&) = delete;
+
+  // Returns whether |num_bytes| at |data| are within the innermost bounds of
+  // the current thread, or true if there are none.
+  static bool Contains(const void* data, size_t num_bytes) {
+    if (current_ == nullptr) {
+      return true;
+    }
+    uintptr_t begin = reinterpret_cast<uintptr_t>(data);
+    return begin >= current_->begin_ && begin <= current_->end_ &&
+           num_bytes <= current_->end_ - begin;
+  }
+
+ private:
+  static inline thread_local const HardenedMessageBounds* current_ = nullptr;
+
+  uintptr_t begin_;
+  uintptr_t end_;
+  const HardenedMessageBounds* previous_;
+};
+
+// What the generated HandleUnknownMember() functions do when a flexible union
+// holds a member unknown to this version of the library.
+enum class UnknownMemberAction {
+  // Keep the member, as flexible unions do by default.
+  kPreserve,
+  // Keep the member, after passing it to the |log| function of the policy.
+  kLog,
+  // Fail with ZX_ERR_NOT_SUPPORTED.
+  kReject,
+};
+
+struct UnknownMemberPolicy {
+  UnknownMemberAction action = UnknownMemberAction::kPreserve;
+  // Called with the FIDL type name of the union and the unknown ordinal.
+  void (*log)(std::string_view fidl_type_name, fidl_xunion_tag_t ordinal) = nullptr;
+};
+
+}  // namespace fidl
+#endif  // LIB_FIDL_LLCPP_UNION_HELPERS_
+{{- if UnionIntrospection }}
+#ifndef LIB_FIDL_LLCPP_UNION_REGISTRY_
+#define LIB_FIDL_LLCPP_UNION_REGISTRY_
+namespace fidl {
+
+// Describes a union member, as listed by a |TypeRegistry| or by the
+// ListMembers() function of the union.
+struct UnionMemberDescriptor {
+  std::string_view name;
+  fidl_xunion_tag_t ordinal;
+  // The FIDL type of the member, e.g. "vector<uint8>:16" or
+  // "fuchsia.library/MyStruct".
+  std::string_view type_name;
+};
+
+// Describes a union, as listed by a |TypeRegistry|.
+struct UnionTypeDescriptor {
+  // The fully qualified FIDL name of the union, e.g. "fuchsia.library/MyUnion".
+  std::string_view type_name;
+  const UnionMemberDescriptor* members;
+  size_t member_count;
+  uint32_t max_num_handles;
+  bool is_flexible;
+};
+
+// Lists the unions of a library, for debugging tools and schema browsers.
+struct TypeRegistry {
+  const UnionTypeDescriptor* unions;
+  size_t union_count;
+
+  // Returns the descriptor of the union named |type_name|, or nullptr.
+  const UnionTypeDescriptor* Find(std::string_view type_name) const {
+    for (size_t i = 0; i < union_count; ++i) {
+      if (unions[i].type_name == type_name) {
+        return &unions[i];
+      }
+    }
+    return nullptr;
+  }
+};
+
+}  // namespace fidl
+#endif  // LIB_FIDL_LLCPP_UNION_REGISTRY_
+{{- end }}
+{{- end }}
+
+{{- define "UnionRegistryDeclaration" }}
+{{- with Unions . }}
+{{ EnsureNamespace (index . 0) }}
+
+// Describes all the unions of this library, including those only available
+// on Fuchsia.
+const ::fidl::TypeRegistry& GetUnionRegistry();
+
+// A union of this library, allocated by |MakeUnionByName|.
+{{- $any := false }}
+using AnyUnion = std::variant<
+  {{- range . }}{{ if not .IsResourceType }}{{ if $any }},{{ end }}
+    ::fidl::ObjectView<{{ .Name }}>{{ $any = true }}
+  {{- end }}{{ end }}
+  {{- if not $any }}
+    std::monostate
+  {{- end }}
+  {{- range . }}{{ if .IsResourceType }}
+{{- IfdefFuchsia -}}
+    , ::fidl::ObjectView<{{ .Name }}>
+{{- EndifFuchsia -}}
+  {{- end }}{{ end }}
+  >;
+
+// Default constructs the union named |type_name|, e.g.
+// "fuchsia.library/MyUnion", in |allocator|. Returns nullopt if this library
+// has no such union.
+cpp17::optional<AnyUnion> MakeUnionByName(std::string_view type_name,
+                                          ::fidl::AnyAllocator& allocator);
+{{- end }}
+{{- end }}
+
+{{- define "UnionRegistryDefinition" }}
+{{- with Unions . }}
+{{ EnsureNamespace (index . 0) }}
+namespace {
+{{- range . }}
+
+constexpr ::fidl::UnionMemberDescriptor k{{ .Name }}MemberDescriptors[] = {
+  {{- range .Members }}
+  {"{{ .Name }}", {{ .Ordinal }}, "{{ .FidlTypeName }}"},
+  {{- end }}
+};
+{{- end }}
+
+constexpr ::fidl::UnionTypeDescriptor kUnionDescriptors[] = {
+  {{- range . }}
+  {
+    .type_name = "{{ .TypeName }}",
+    .members = k{{ .Name }}MemberDescriptors,
+    .member_count = {{ len .Members }},
+    .max_num_handles = {{ .MaxHandles }},
+    .is_flexible = {{ .IsFlexible }},
+  },
+  {{- end }}
+};
+
+}  // namespace
+
+const ::fidl::TypeRegistry& GetUnionRegistry() {
+  static constexpr ::fidl::TypeRegistry kRegistry{kUnionDescriptors, {{ len . }}};
+  return kRegistry;
+}
+
+cpp17::optional<AnyUnion> MakeUnionByName(std::string_view type_name,
+                                          ::fidl::AnyAllocator& allocator) {
+  {{- range . }}
+  {{- if .IsResourceType }}
+{{- IfdefFuchsia -}}
+  {{- end }}
+  if (type_name == "{{ .TypeName }}") {
+    return AnyUnion(std::in_place_type<::fidl::ObjectView<{{ .Name }}>>, allocator);
+  }
+  {{- if .IsResourceType }}
+{{- EndifFuchsia -}}
+  {{- end }}
+  {{- end }}
+  return cpp17::nullopt;
+}
+{{- end }}
+{{- end }}
+
 {{- define "UnionForwardDeclaration" }}
 {{ EnsureNamespace . }}
 class {{ .Name }};
+{{- if and NaturalVariantUnions .HasNaturalVariant .HasExperimentalMembers }}
+{{ EnsureNamespace .NaturalVariant }}
+class {{ .NaturalVariant.Self }};
+{{- end }}
+{{- end }}
+
+{{/* TODO(fxbug.dev/36441): Remove __Fuchsia__ ifdefs once we have non-Fuchsia
+     emulated handles for C++. */}}
+{{- define "UnionDeclaration" }}
+{{ EnsureNamespace . }}
+{{ if .IsResourceType }}
+{{- IfdefFuchsia -}}
+{{- end }}
+{{- if .HasCodingTable }}
+extern "C" const fidl_type_t {{ .CodingTableType }};
+{{- end }}
+{{- if not .IsResourceType }}
+{{- if DeepCopy }}
+class Owned{{ .Name }};
+{{- end }}
+{{- if FlatProjections }}
+struct Flat{{ .Name }};
+{{- end }}
+{{- end }}
+{{ .Docs }}
+{{- if LayoutComments }}
+// Wire layout, {{ .InlineSize }} bytes inline and {{ OutOfLineBound .MaxOutOfLine }} out-of-line:
+//   offset 0, 8 bytes: ordinal
+//   offset 8, 16 bytes: envelope (num_bytes, num_handles, data)
+// Out-of-line data of each member, besides the content of the envelope:
+{{- range .Members }}
+//   {{ .Name }} ({{ .Ordinal }}): {{ OutOfLineBound .MaxOutOfLine }}
+{{- end }}
+{{- end }}
+class {{ .Name }} {
+  public:
+  {{- if ZeroUnionPadding }}
+  {{ .Name }}() : ordinal_({{ .WireInvalidOrdinal }}), envelope_{} {
+    // |envelope_| directly follows |ordinal_|, so member initialization
+    // already sets every byte of the union. Some static analyzers still
+    // report padding there, so debug builds also zero the whole object, which
+    // leaves the same absent union, to silence them.
+    static_assert(offsetof({{ .Name }}, envelope_) == sizeof(ordinal_));
+#ifndef NDEBUG
+    std::memset(static_cast<void*>(this), 0, sizeof(*this));
+#endif
+  }
+  {{- else }}
+  {{ .Name }}() : ordinal_({{ .WireInvalidOrdinal }}), envelope_{} {}
+  {{- end }}
+
+  {{ .Name }}(const {{ .Name }}&) = default;
+  {{ .Name }}& operator=(const {{ .Name }}&) = default;
+  // The moved-from union is left absent, with an invalid tag and an empty
+  // envelope, as if default constructed
+  {{- if .IsResourceType }}. Moving transfers ownership of the
+  // handles, so closing the handles of the moved-from union is a no-op
+  {{- end }}.
+  // In debug builds, the data pointer of its envelope is then poisoned, so
+  // that any later access through it faults instead of reading stale arena
+  // memory.
+  {{ .Name }}({{ .Name }}&& other) noexcept
+      : ordinal_(other.ordinal_), envelope_(other.envelope_) {
+    other.MarkMovedFrom();
+  }
+  {{ .Name }}& operator=({{ .Name }}&& other) noexcept {
+    if (this != &other) {
+      ordinal_ = other.ordinal_;
+      envelope_ = other.envelope_;
+      other.MarkMovedFrom();
+    }
+    return *this;
+  }
+
+  enum class {{ .TagEnum.Self }} : fidl_xunion_tag_t {
+  {{- range .Members }}
+    {{ .TagName.Self }} = {{ .Ordinal }},  // {{ .Ordinal | printf "%#x" }}
+  {{- end }}
+  {{- if .IsFlexible }}
+    {{ .TagUnknown.Self }} = ::std::numeric_limits<::fidl_union_tag_t>::max(),
+  {{- end }}
+  };
+
+  // Returns the name of the member selected by |tag|, or an empty string for
+  // a tag that names no member. Usable in constant expressions.
+  static constexpr std::string_view TagName({{ .TagEnum.Self }} tag) noexcept {
+    switch (tag) {
+    {{- range .Members }}
+      case {{ $.TagEnum.Self }}::{{ .TagName.Self }}:
+        return "{{ .Name }}";
+    {{- end }}
+      default:
+        return "";
+    }
+  }
+
+  {{- if UnionIntrospection }}
+
+  // Describes the members of this union, in declaration order.
+  static cpp20::span<const ::fidl::UnionMemberDescriptor> ListMembers() {
+    static constexpr ::fidl::UnionMemberDescriptor kMembers[] = {
+    {{- range .Members }}
+        {"{{ .Name }}", {{ .Ordinal }}, "{{ .FidlTypeName }}"},
+    {{- end }}
+    };
+    return kMembers;
+  }
+  {{- end }}
+  {{- if .HasCapabilityMembers }}
+
+  // Must be passed to the getters of the members annotated with
+  // @requires_cap. Only |::fidl::CapabilityIssuer<{{ .Name }}>| can create one.
+  class CapabilityToken {
+   private:
+    friend struct ::fidl::CapabilityIssuer<{{ .Name }}>;
+    // User-provided rather than defaulted: a class whose constructors are all
+    // defaulted is an aggregate in C++17, which anyone can create with
+    // |CapabilityToken{}|.
+    CapabilityToken() {}
+  };
+  {{- end }}
+
+  {{/* NOTE: Invalid (ordinal 0) is the only absent representation on the
+       wire: it encodes an absent nullable union. A second sentinel, to tell
+       "explicitly cleared" from "never set", would be encoded as an unknown
+       ordinal, which strict unions reject and flexible peers read as an
+       unknown member. Tri-state fields should wrap the union instead, e.g. in
+       a cpp17::optional. */ -}}
+  bool has_invalid_tag() const noexcept { return ordinal_ == {{ .WireInvalidOrdinal }}; }
+
+  // Returns the ordinal of the member held by this union, which may be
+  // unknown, or 0 if the tag is invalid. Unlike |which()|, it never asserts,
+  // for diagnostics of default constructed or malformed unions.
+  fidl_xunion_tag_t raw_ordinal() const noexcept { return static_cast<fidl_xunion_tag_t>(ordinal_); }
+
+  // Returns a key identifying the member held by this union, but not its
+  // value, for routing tables indexed by variant. It is the ordinal, so it is
+  // stable across builds and versions of the library, and 0 if the tag is
+  // invalid. Unknown members get distinct keys.
+  uint64_t RoutingKey() const noexcept { return static_cast<uint64_t>(ordinal_); }
+
+  {{- range $index, $member := .Members }}
+  {{- if .IsExperimental }}
+
+  // |{{ .Name }}| is experimental: its accessors are private unless
+  // FIDL_ALLOW_EXPERIMENTAL is defined.
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ private:
+#endif
+  {{- end }}
+
+  bool is_{{ .Name }}() const noexcept { return ordinal_ == {{ .WireOrdinalName }}; }
+{{ "" }}
+  {{- if .Validator }}
+  // The |With{{ .UpperCamelCaseName }}| functions abort if |{{ .Validator }}|
+  // rejects the value.
+  {{- end }}
+  static {{ $.Name }} With{{ .UpperCamelCaseName }}(::fidl::ObjectView<{{ .Type }}> val) {
+    {{ $.Name }} result;
+    {{- if .Validator }}
+    zx_status_t status = result.set_{{ .Name }}(val);
+    ZX_ASSERT_MSG(status == ZX_OK, "{{ .Validator }} rejected the value of |{{ .Name }}|");
+    {{- else }}
+    result.set_{{ .Name }}(val);
+    {{- end }}
+    return result;
+  }
+
+  template <typename... Args>
+  static {{ $.Name }} With{{ .UpperCamelCaseName }}(::fidl::AnyAllocator& allocator, Args&&... args) {
+    {{ $.Name }} result;
+    {{- if .Validator }}
+    zx_status_t status = result.set_{{ .Name }}(allocator, std::forward<Args>(args)...);
+    ZX_ASSERT_MSG(status == ZX_OK, "{{ .Validator }} rejected the value of |{{ .Name }}|");
+    {{- else if SimdAlignment .Type }}
+    result.set_{{ .Name }}(allocator, std::forward<Args>(args)...);
+    {{- else }}
+    result.set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}>(allocator,
+                           std::forward<Args>(args)...));
+    {{- end }}
+    return result;
+  }
+{{ "" }}
+  {{- .Docs }}
+  {{- if .Validator }}
+  // Returns ZX_ERR_INVALID_ARGS, leaving the union unchanged, if
+  // |{{ .Validator }}| rejects the value.
+  [[nodiscard]] zx_status_t set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}> elem) {
+    if (elem.get() != nullptr && !{{ .Validator }}(*elem)) {
+      return ZX_ERR_INVALID_ARGS;
+    }
+  {{- else }}
+  void set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}> elem) {
+  {{- end }}
+    {{- if .Type.MaxElements }}
+    ZX_DEBUG_ASSERT_MSG(elem.get() == nullptr || elem->count() <= {{ .Type.MaxElements }},
+                        "{{ .Name }} exceeds its bound of {{ .Type.MaxElements }} elements");
+    {{- end }}
+    {{- if and TraceHandles .Type.IsResource }}
+    TRACE_INSTANT("fidl", "UnionSetHandles", TRACE_SCOPE_THREAD, "union", "{{ $.TypeName }}",
+                  "member", "{{ .Name }}");
+    {{- end }}
+    ordinal_ = {{ .WireOrdinalName }};
+    envelope_.data = ::fidl::ObjectView<void>::FromExternal(static_cast<void*>(elem.get()));
+    {{- if .Validator }}
+    return ZX_OK;
+    {{- end }}
+  }
+  {{- $align := SimdAlignment .Type }}
+  {{- if $align }}
+
+  // Allocates |{{ .Name }}| at a multiple of {{ $align }} bytes, for |aligned_{{ .Name }}_data()|.
+  template <typename... Args>
+  {{ if .Validator }}[[nodiscard]] zx_status_t{{ else }}void{{ end }} set_{{ .Name }}(::fidl::AnyAllocator& allocator, Args&&... args) {
+    ::fidl::VectorView<uint8_t> storage(allocator, sizeof({{ .Type }}) + {{ $align }} - 1);
+    void* data = storage.mutable_data();
+    size_t space = storage.count();
+    std::align({{ $align }}, sizeof({{ .Type }}), data, space);
+    {{ if .Validator }}return {{ end }}set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}>::FromExternal(
+        new (data) {{ .Type }}(std::forward<Args>(args)...)));
+  }
+  {{- else }}
+
+  template <typename... Args>
+  {{- if .Validator }}
+  [[nodiscard]] zx_status_t set_{{ .Name }}(::fidl::AnyAllocator& allocator, Args&&... args) {
+    return set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}>(allocator, std::forward<Args>(args)...));
+  }
+  {{- else }}
+  void set_{{ .Name }}(::fidl::AnyAllocator& allocator, Args&&... args) {
+    ordinal_ = {{ .WireOrdinalName }};
+    set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}>(allocator, std::forward<Args>(args)...));
+  }
+  {{- end }}
+  {{- end }}
+  {{- if .RequiresCap }}
+
+  // |{{ .Name }}| requires a capability: the getters below are private, and
+  // the public ones take a |CapabilityToken|.
+ private:
+  {{- end }}
+{{ "" }}
+  {{- .Docs }}
+  {{ .Type }}& mutable_{{ .Name }}(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()){{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+    {{ TagCheck .WireOrdinalName (printf "mutable_%s" .Name) .Name }}
+    {{- if Hardened }}
+    {{ BoundsCheck .Type (printf "mutable_%s" .Name) .Name }}
+    {{- end }}
+    {{- if AccessCoverage }}
+    access_counts_[{{ $index }}].fetch_add(1, std::memory_order_relaxed);
+    {{- end }}
+    return *static_cast<{{ .Type }}*>(envelope_.data.get());
+  }
+  {{- if and ByValueGetterMaxSize .Type.IsPrimitiveType }}
+  // Small members are returned by value, so that calling this on a temporary
+  // union does not produce a dangling reference.
+  std::conditional_t<sizeof({{ .Type }}) <= {{ ByValueGetterMaxSize }}, {{ .Type }}, const {{ .Type }}&>
+  {{ .Name }}(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const noexcept{{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+  {{- else }}
+  const {{ .Type }}& {{ .Name }}(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const noexcept{{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+  {{- end }}
+    {{ TagCheck .WireOrdinalName .Name .Name }}
+    {{- if Hardened }}
+    {{ BoundsCheck .Type .Name .Name }}
+    {{- end }}
+    {{- if AccessCoverage }}
+    access_counts_[{{ $index }}].fetch_add(1, std::memory_order_relaxed);
+    {{- end }}
+    return *static_cast<{{ .Type }}*>(envelope_.data.get());
+  }
+  {{- if Eq .Type.Kind TypeKinds.Vector }}
+
+  // Returns the elements of |{{ .Name }}|, for rewriting them in place.
+  cpp20::span<{{ .Type.ElementType }}> mutable_{{ .Name }}_span(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) {
+    {{ TagCheck .WireOrdinalName (printf "mutable_%s_span" .Name) .Name }}
+    {{- if Hardened }}
+    {{ BoundsCheck .Type (printf "mutable_%s_span" .Name) .Name }}
+    {{- end }}
+    {{- if AccessCoverage }}
+    access_counts_[{{ $index }}].fetch_add(1, std::memory_order_relaxed);
+    {{- end }}
+    auto& vector = *static_cast<{{ .Type }}*>(envelope_.data.get());
+    return cpp20::span<{{ .Type.ElementType }}>(vector.mutable_data(), vector.count());
+  }
+  {{- end }}
+  {{- if Eq .Type.Kind TypeKinds.String }}
+
+  // Returns a view of |{{ .Name }}|, which refers to the same data.
+  std::string_view {{ .Name }}_str(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const noexcept {
+    const ::fidl::StringView& string = {{ .Name }}(caller_file, caller_line);
+    return std::string_view(string.data(), string.size());
+  }
+  {{- end }}
+  {{- if $.IsFlexible }}
+
+  // Returns |{{ .Name }}|, or nullopt if the union holds another member,
+  // including an unknown one. Unlike |{{ .Name }}()|, it never asserts.
+  cpp17::optional<std::reference_wrapper<const {{ .Type }}>> {{ .Name }}_view() const noexcept {
+    if (ordinal_ != {{ .WireOrdinalName }}) {
+      return cpp17::nullopt;
+    }
+    {{- if AccessCoverage }}
+    access_counts_[{{ $index }}].fetch_add(1, std::memory_order_relaxed);
+    {{- end }}
+    return std::cref(*static_cast<const {{ .Type }}*>(envelope_.data.get()));
+  }
+  {{- end }}
+  {{- with SimdAlignment .Type }}
+
+  // Returns the elements of |{{ $member.Name }}|, aligned to {{ . }} bytes. |{{ $member.Name }}| must
+  // have been set through |set_{{ $member.Name }}(allocator, ...)|: decoded unions only
+  // guarantee the FIDL alignment of 8 bytes.
+  {{ $member.Type.ElementType }}* aligned_{{ $member.Name }}_data(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) {
+    {{ TagCheck $member.WireOrdinalName (printf "aligned_%s_data" $member.Name) $member.Name }}
+    {{ $member.Type.ElementType }}* data = static_cast<{{ $member.Type }}*>(envelope_.data.get())->data();
+    ZX_ASSERT_MSG(reinterpret_cast<uintptr_t>(data) % {{ . }} == 0,
+                  "%s:%d: aligned_{{ $member.Name }}_data() called on |{{ $member.Name }}| not aligned to {{ . }} bytes",
+                  caller_file, caller_line);
+    return static_cast<{{ $member.Type.ElementType }}*>(__builtin_assume_aligned(data, {{ . }}));
+  }
+  {{- end }}
+  {{- if and LenientGetters (not .Type.IsResource) }}
+
+  // Like |{{ .Name }}()|, but logs a warning and returns a default constructed
+  // value instead of asserting when the union does not hold |{{ .Name }}|.
+  const {{ .Type }}& {{ .Name }}_or_default(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const {
+    if (ordinal_ != {{ .WireOrdinalName }}) {
+      static const {{ .Type }} kDefault{};
+      fprintf(stderr, "%s:%d: warning: {{ .Name }}_or_default() called on a union not holding |{{ .Name }}|\n",
+              caller_file, caller_line);
+      return kDefault;
+    }
+    {{- if AccessCoverage }}
+    access_counts_[{{ $index }}].fetch_add(1, std::memory_order_relaxed);
+    {{- end }}
+    return *static_cast<{{ .Type }}*>(envelope_.data.get());
+  }
+  {{- end }}
+  {{- if FitResultGetters }}
+
+  // Returns |{{ .Name }}|, or fit::failed if the union holds another member.
+  fit::result<fit::failed, std::reference_wrapper<const {{ .Type }}>> {{ .Name }}_result() const {
+    if (ordinal_ != {{ .WireOrdinalName }}) {
+      return fit::failed();
+    }
+    {{- if AccessCoverage }}
+    access_counts_[{{ $index }}].fetch_add(1, std::memory_order_relaxed);
+    {{- end }}
+    return fit::ok(std::cref(*static_cast<{{ .Type }}*>(envelope_.data.get())));
+  }
+  {{- end }}
+  {{- if .RequiresCap }}
+  {{- if .IsExperimental }}
+#ifdef FIDL_ALLOW_EXPERIMENTAL
+ public:
+#endif
+  {{- else }}
+ public:
+  {{- end }}
+
+  {{ .Type }}& mutable_{{ .Name }}(CapabilityToken, const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()){{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+    return mutable_{{ .Name }}(caller_file, caller_line);
+  }
+  decltype(auto) {{ .Name }}(CapabilityToken, const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const noexcept{{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+    return {{ .Name }}(caller_file, caller_line);
+  }
+  {{- end }}
+  {{- if .IsExperimental }}
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ public:
+#endif
+  {{- end }}
+  {{- end }}
+
+  {{- with .PrimaryMember }}
+
+  // |{{ .Name }}| is the primary member of this union.
+  {{ .Type }}& mutable_value(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()){{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+    return mutable_{{ .Name }}(caller_file, caller_line);
+  }
+  decltype(auto) value(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const noexcept{{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+    return {{ .Name }}(caller_file, caller_line);
+  }
+  {{- end }}
+
+  {{- if .IsFlexible }}
+  {{ .TagEnum }} which() const noexcept;
+  {{- else }}
+  {{ .TagEnum }} which() const noexcept {
+    ZX_ASSERT(!has_invalid_tag());
+    return static_cast<{{ .TagEnum }}>(ordinal_);
+  }
+  {{- end }}
+  {{- if AllocationReport }}
+
+  // Returns the bytes the member of this union occupies in its arena,
+  // including the strings and vectors it refers to, to attribute arena usage.
+  // The contents of struct, table and union members are not traversed.
+  ::fidl::AllocationReport ReportAllocation() const {
+    ::fidl::AllocationReport report;
+    switch (ordinal_) {
+    {{- range $member := .Members }}
+      case {{ .WireOrdinalName }}: {
+        report.inline_bytes = FIDL_ALIGN(sizeof({{ .Type }}));
+        {{- with OutOfLineBytes "report.out_of_line_bytes" "value" .Type }}
+        const {{ $member.Type }}& value = *static_cast<const {{ $member.Type }}*>(envelope_.data.get());
+        {{ . }}
+        {{- end }}
+        break;
+      }
+    {{- end }}
+      default:
+        // An invalid tag has no member, and unknown members are only ever
+        // decoded in place, outside of an arena.
+        break;
+    }
+    return report;
+  }
+  {{- end }}
+  {{- if TestHelpers }}
+
+  // For tests: aborts, naming the member this union holds, unless it holds
+  // the member of |expected|.
+  void AssertTag({{ .TagEnum.Self }} expected, const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const {
+    if (!has_invalid_tag() && which() == expected) {
+      return;
+    }
+    std::string_view actual = has_invalid_tag() ? "<invalid tag>" : TagName(which());
+    if (actual.empty()) {
+      actual = "<unknown member>";
+    }
+    std::string_view wanted = TagName(expected);
+    ZX_ASSERT_MSG(false, "%s:%d: expected {{ .Name }} to hold |%.*s|, but it holds |%.*s|", caller_file,
+                  caller_line, static_cast<int>(wanted.size()), wanted.data(),
+                  static_cast<int>(actual.size()), actual.data());
+  }
+  {{- end }}
+
+  // Returns whether the union holds the member of any of |tags|.
+  template <typename... Tags>
+  bool is_any_of(Tags... tags) const noexcept {
+    static_assert((std::is_same_v<Tags, {{ .TagEnum.Self }}> && ...), "is_any_of takes {{ .TagEnum.Self }} values");
+    if (has_invalid_tag()) {
+      return false;
+    }
+    const {{ .TagEnum.Self }} tag = which();
+    return ((tag == tags) || ...);
+  }
+
+  {{- if .IsFlexible }}
+  {{- if .IsResourceType }}
+
+  // Moves this union into the result if it holds a member known to this
+  // version of the library, or has an invalid tag. Returns cpp17::nullopt,
+  // leaving this union untouched, if it holds an unknown member.
+  cpp17::optional<{{ .Name }}> ProjectToKnown() && {
+  {{- else }}
+
+  // Returns a copy of this union, sharing its member, if it holds a member
+  // known to this version of the library, or has an invalid tag. Returns
+  // cpp17::nullopt if it holds an unknown member.
+  cpp17::optional<{{ .Name }}> ProjectToKnown() const {
+  {{- end }}
+    switch (ordinal_) {
+    {{- range .Members }}
+      case {{ .WireOrdinalName }}:
+    {{- end }}
+      case {{ .WireInvalidOrdinal }}:
+        return {{ if .IsResourceType }}std::move(*this){{ else }}*this{{ end }};
+      default:
+        return cpp17::nullopt;
+    }
+  }
+  {{- end }}
+
+  {{- if .IsFlexible }}
+
+  // Passed to the |apply| callback when the active member is unknown.
+  struct UnknownMember {};
+  {{- end }}
+
+  // Calls |f| with a mutable reference to the active member. Does nothing if
+  // the tag is invalid.
+  {{- if .IsFlexible }} If the active member is unknown, |f| is called with
+  // |UnknownMember| when it accepts one, and is not called otherwise.
+  {{- end }}
+  {{- if .HasHiddenMembers }} Members that require a
+  // |CapabilityToken|, or are experimental, are not passed to |f|.
+  {{- end }}
+  template <typename F>
+  void apply(F&& f) {
+    switch (ordinal_) {
+    {{- range .Members }}
+    {{- if not .IsHidden }}
+      case {{ .WireOrdinalName }}:
+        std::forward<F>(f)(*static_cast<{{ .Type }}*>(envelope_.data.get()));
+        break;
+    {{- end }}
+    {{- end }}
+    {{- range .Members }}
+    {{- if .IsHidden }}
+      case {{ .WireOrdinalName }}:
+    {{- end }}
+    {{- end }}
+      case {{ .WireInvalidOrdinal }}:
+        break;
+      default:
+      {{- if .IsFlexible }}
+        if constexpr (std::is_invocable_v<F, UnknownMember>) {
+          std::forward<F>(f)(UnknownMember{});
+        }
+      {{- end }}
+        break;
+    }
+  }
+
+  {{- with .Members }}
+
+  // Returns |f| called with a const reference to the active member. |f| must
+  // return the same type for every member, and a value-initialized result is
+  // returned if the tag is invalid{{ if $.IsFlexible }} or the member is unknown{{ end }}.
+  {{- if $.HasHiddenMembers }} Members that require a
+  // |CapabilityToken|, or are experimental, are not passed to |f|, and also
+  // yield that result.
+  {{- end }}
+  template <typename F>
+  auto visit(F&& f) const -> std::invoke_result_t<F, const {{ (index . 0).Type }}&> {
+    using Result = std::invoke_result_t<F, const {{ (index . 0).Type }}&>;
+    switch (ordinal_) {
+    {{- range . }}
+    {{- if not .IsHidden }}
+      case {{ .WireOrdinalName }}:
+        static_assert(std::is_same_v<std::invoke_result_t<F, const {{ .Type }}&>, Result>,
+                      "the visitor must return the same type for every member");
+        return std::forward<F>(f)(*static_cast<const {{ .Type }}*>(envelope_.data.get()));
+    {{- end }}
+    {{- end }}
+      default:
+        return Result();
+    }
+  }
+
+  // Calls |f|, which returns whether to continue, with a const reference to
+  // the active member. Returns false if |f| returned false, and true
+  // otherwise, including when |f| was not called because the tag is
+  // invalid{{ if $.IsFlexible }} or the member is unknown{{ end }}
+  {{- if $.HasHiddenMembers }}
+  // or requires a |CapabilityToken| or is experimental
+  {{- end }}.
+  template <typename F>
+  bool visit_until(F&& f) const {
+    switch (ordinal_) {
+    {{- range . }}
+    {{- if not .IsHidden }}
+      case {{ .WireOrdinalName }}:
+        return std::forward<F>(f)(*static_cast<const {{ .Type }}*>(envelope_.data.get()));
+    {{- end }}
+    {{- end }}
+      default:
+        return true;
+    }
+  }
+  {{- end }}
+  {{- if StructuredBindings }}
+
+  // A reference to the active member, as bound by |get<1>|. It is
+  // std::monostate if the member is unknown to this version of the library
+  {{- if .HasHiddenMembers }}
+  // or requires a |CapabilityToken| or is experimental
+  {{- end }}.
+  using ActiveMember = std::variant<
+  {{- range .Members }}
+      std::reference_wrapper<const {{ .Type }}>,
+  {{- end }}
+      std::monostate>;
+
+  // Makes the union usable in structured bindings, as in
+  // |const auto [tag, member] = u;|, which binds the tag returned by which()
+  // and a reference to the active member. The tag must be valid.
+  template <size_t I>
+  auto get() const {
+    static_assert(I < 2, "a union binds a tag and a member");
+    if constexpr (I == 0) {
+      return which();
+    } else {
+      switch (ordinal_) {
+      {{- range $index, $member := .Members }}
+      {{- if not .IsHidden }}
+        case {{ .WireOrdinalName }}:
+          return ActiveMember(std::in_place_index<{{ $index }}>,
+                              std::cref(*static_cast<const {{ .Type }}*>(envelope_.data.get())));
+      {{- end }}
+      {{- end }}
+        default:
+          return ActiveMember(std::in_place_index<{{ len .Members }}>);
+      }
+    }
+  }
+  {{- end }}
+
+  {{- $contiguous := true }}
+  {{- range .Members }}
+  {{- if or (not (HasContiguousBytes .Type)) .IsHidden }}
+  {{- $contiguous = false }}
+  {{- end }}
+  {{- end }}
+  {{- if $contiguous }}
+
+  // Returns the bytes of the active member, for hashing its contents without
+  // knowing its type. Every member of this union is of a primitive, bits or
+  // enum type, or an array of those, whose value is entirely in its own
+  // bytes. The span is empty when the tag is invalid{{ if .IsFlexible }} or the member is unknown{{ end }}.
+  cpp20::span<const uint8_t> active_member_bytes() const noexcept {
+    switch (ordinal_) {
+    {{- range .Members }}
+      case {{ .WireOrdinalName }}:
+        return cpp20::span<const uint8_t>(static_cast<const uint8_t*>(envelope_.data.get()),
+                                          sizeof({{ .Type }}));
+    {{- end }}
+      default:
+        return {};
+    }
+  }
+  {{- end }}
+  {{- if and UnionEncode .HasCodingTable (not .IsResourceType) }}
+
+  // Appends the encoding of this union, which holds the ordinal and the bytes
+  // of the active member followed by all of its out-of-line data, to |out|,
+  // for hashing its contents without knowing its type. The encoding is
+  // canonical, so that equal values append equal bytes. A copy of this union
+  // is encoded, so that it can be called on a const union.
+  zx_status_t AppendEncodedBytes(std::vector<uint8_t>& out) const {
+    struct Appender {
+      void WriteBytes(const void* bytes, uint32_t num_bytes) {
+        const uint8_t* begin = static_cast<const uint8_t*>(bytes);
+        out.insert(out.end(), begin, begin + num_bytes);
+      }
+      std::vector<uint8_t>& out;
+    } appender{out};
+    {{ .Name }} copy(*this);
+    return copy.Encode(appender);
+  }
+  {{- end }}
+  {{- if TypeErasedSet }}
+
+  // Sets the member selected by |tag| to a copy of |value|, allocated from
+  // |allocator|, if |value| holds the type of that member. Strings and vectors
+  // keep referring to the same data. Returns whether the member was set; the
+  // union is left unchanged otherwise.
+  {{- if .IsResourceType }} Members which may hold handles
+  // cannot be copied out of a std::any, and are never set.
+  {{- end }}
+  {{- if .HasHiddenMembers }} Members that require a
+  // |CapabilityToken|, or are experimental, are never set either.
+  {{- end }}
+  bool Set({{ .TagEnum.Self }} tag, const std::any& value, ::fidl::AnyAllocator& allocator) {
+    switch (tag) {
+    {{- range .Members }}
+    {{- if not (or .Type.IsResource .IsHidden) }}
+      case {{ $.TagEnum.Self }}::{{ .TagName.Self }}:
+        if (const auto* member = std::any_cast<{{ .Type }}>(&value)) {
+          {{- if .Validator }}
+          return set_{{ .Name }}(allocator, *member) == ZX_OK;
+          {{- else }}
+          set_{{ .Name }}(allocator, *member);
+          return true;
+          {{- end }}
+        }
+        return false;
+    {{- end }}
+    {{- end }}
+      default:
+        return false;
+    }
+  }
+  {{- end }}
+
+  {{- if UniformPresence }}
+
+  // Returns a mask with the bit for the active member set, at the position a
+  // table would use for the same ordinal (bit |ordinal - 1|), or zero if
+  // the tag is invalid or unknown. fidlgen rejects unions with ordinals above
+  // 64, which a mask cannot represent.
+  uint64_t PresenceMask() const noexcept {
+    switch (ordinal_) {
+    {{- range .Members }}
+      case {{ .WireOrdinalName }}:
+        return uint64_t{1} << ({{ .Ordinal }} - 1);
+    {{- end }}
+      default:
+        return 0;
+    }
+  }
+  {{- end }}
+
+  // Destroys the union at |slot| and default constructs a new one in its
+  // place, for object pools that recycle union storage.
+  {{- if .IsResourceType }} Handles are not
+  // closed: call |_CloseHandles| first to release them.
+  {{- end }}
+  static void Recycle({{ .Name }}* slot) noexcept {
+    slot->~{{ .Name }}();
+    new (slot) {{ .Name }}();
+  }
+
+  {{- if RangeCompat }}
+
+  // Ranges over this union once if it has a valid tag, and not at all
+  // otherwise, like an optional value.
+  {{ .Name }}* begin() { return has_invalid_tag() ? end() : this; }
+  {{ .Name }}* end() { return this + 1; }
+  const {{ .Name }}* begin() const noexcept { return has_invalid_tag() ? end() : this; }
+  const {{ .Name }}* end() const noexcept { return this + 1; }
+  {{- end }}
+
+  {{/* TODO: Accept -wire-format=v2, inlining members of up to 4 bytes in
+       the envelope. This needs v2 type shapes (HasPointer, PrimarySize and
+       MaxOutOfLine change) in the IR, and fidl_xunion_v2_t and v2 coding
+       tables in the runtime, none of which exist yet. */ -}}
+  // The wire format this union is encoded in, as targeted by -wire-format.
+  static constexpr ::fidl::WireFormatVersion kWireFormat = ::fidl::WireFormatVersion::{{ WireFormat }};
+
+  // Fingerprints the wire format of this union: its strictness, type shape,
+  // and member ordinals and types. Peers can compare it during a handshake.
+  static constexpr uint64_t WireAbiHash = {{ .WireAbiHash | printf "%#x" }}ull;
+
+  // Returns whether a peer advertising |peer_hash| uses the same wire format.
+  static constexpr bool VerifyWireCompat(uint64_t peer_hash) { return peer_hash == WireAbiHash; }
+
+  // Like |VerifyWireCompat(peer_hash)|, but also accepts peers whose hash is
+  // paired with |WireAbiHash|, in either order, in |compatible|. This lists
+  // versions known to remain wire compatible, such as after renaming a type.
+  template <size_t N>
+  static constexpr bool VerifyWireCompat(
+      uint64_t peer_hash, const ::std::array<::std::pair<uint64_t, uint64_t>, N>& compatible) {
+    if (VerifyWireCompat(peer_hash)) {
+      return true;
+    }
+    for (const auto& [a, b] : compatible) {
+      if ((a == WireAbiHash && b == peer_hash) || (a == peer_hash && b == WireAbiHash)) {
+        return true;
+      }
+    }
+    return false;
+  }
+{{ if .HasCodingTable }}
+  static constexpr const fidl_type_t* Type = &{{ .CodingTableType }};
+{{- else }}
+  // Synthesized by fidlgen without a coding table, so it cannot be encoded.
+{{- end }}
+  static constexpr uint32_t MaxNumHandles = {{ .MaxHandles }};
+  static constexpr uint32_t PrimarySize = {{ .InlineSize }};
+  [[maybe_unused]]
+  static constexpr uint32_t MaxOutOfLine = {{ .MaxOutOfLine }};
+  static constexpr bool HasPointer = {{ .HasPointer }};
+  static constexpr uint32_t MemberCount = {{ len .Members }};
+  static constexpr bool IsFlexible = {{ .IsFlexible }};
+  {{- if .IsResourceType }}
+  // Whether each member, in declaration order, may carry handles.
+  static constexpr ::std::array<bool, MemberCount> kMemberIsResource = {
+    {{- range $index, $member := .Members }}{{ if $index }}, {{ end }}{{ $member.Type.IsResource }}{{ end -}}
+  };
+  {{- end }}
+
+  // Runtime metadata about this union, for introspection and debugging.
+  struct UnionDescriptor {
+    uint32_t member_count;
+    uint32_t max_num_handles;
+    bool is_flexible;
+    bool has_invalid_tag;
+    // Only meaningful when |has_invalid_tag| is false.
+    {{ .TagEnum.Self }} tag;
+  };
+
+  UnionDescriptor Describe() const {
+    return UnionDescriptor{
+        .member_count = MemberCount,
+        .max_num_handles = MaxNumHandles,
+        .is_flexible = IsFlexible,
+        .has_invalid_tag = has_invalid_tag(),
+        .tag = has_invalid_tag() ? {{ .TagEnum.Self }}{} : which(),
+    };
+  }
+  {{- if and UnionEncode .HasCodingTable }}
+
+  // Encodes this union without going through a channel, for use with custom
+  // transports. |Encoder| must provide
+  //
+  //     void WriteBytes(const void* bytes, uint32_t num_bytes);
+  {{- if .IsResourceType }}
+  //     void AddHandle(const zx_handle_disposition_t& handle);
+  //
+  // Ownership of the encoded handles is transferred to |encoder|.
+  {{- end }}
+  template <typename Encoder>
+  zx_status_t Encode(Encoder& encoder) {
+    ::fidl::internal::IovecBuffer iovecs;
+    {{ .BackingBufferType }} backing_buffer;
+    {{- if gt .MaxHandles 0 }}
+    zx_handle_disposition_t handles[std::min(ZX_CHANNEL_MAX_MSG_HANDLES, MaxNumHandles)];
+    {{- end }}
+    ::fidl::OutgoingMessage message(::fidl::OutgoingMessage::ConstructorArgs{
+        .iovecs = iovecs,
+        .iovec_capacity = ::fidl::internal::IovecBufferSize,
+    {{- if gt .MaxHandles 0 }}
+        .handles = handles,
+        .handle_capacity = std::min(ZX_CHANNEL_MAX_MSG_HANDLES, MaxNumHandles),
+    {{- end }}
+        .backing_buffer = backing_buffer.data(),
+        .backing_buffer_capacity = backing_buffer.size(),
+    });
+    message.Encode<{{ .Name }}>(this);
+    if (!message.ok()) {
+      return message.status();
+    }
+    const fidl_outgoing_msg_t* raw = message.message();
+    for (uint32_t i = 0; i < raw->iovec.num_iovecs; ++i) {
+      encoder.WriteBytes(raw->iovec.iovecs[i].buffer, raw->iovec.iovecs[i].capacity);
+    }
+    {{- if .IsResourceType }}
+    for (uint32_t i = 0; i < raw->iovec.num_handles; ++i) {
+      encoder.AddHandle(raw->iovec.handles[i]);
+    }
+    message.ReleaseHandles();
+    {{- end }}
+    return ZX_OK;
+  }
+
+  // Like |Encode|, but appends the encoded regions to |builder| as iovec
+  // entries instead of copying their bytes, so that large members are sent
+  // from where they are. |IovecBuilder| must provide
+  //
+  //     cpp20::span<uint8_t> backing_buffer();
+  //     void Append(const void* buffer, uint32_t capacity);
+  {{- if .IsResourceType }}
+  //     void AddHandle(const zx_handle_disposition_t& handle);
+  {{- end }}
+  //
+  // The backing buffer, which must be large enough for the regions that the
+  // encoder rewrites, such as the union itself, and the out-of-line data of
+  // this union must both outlive the entries.
+  {{- if .IsResourceType }} Ownership of the encoded handles is
+  // transferred to |builder|.
+  {{- end }}
+  template <typename IovecBuilder>
+  zx_status_t EncodeToIovecs(IovecBuilder& builder) {
+    ::fidl::internal::IovecBuffer iovecs;
+    cpp20::span<uint8_t> backing_buffer = builder.backing_buffer();
+    {{- if gt .MaxHandles 0 }}
+    zx_handle_disposition_t handles[std::min(ZX_CHANNEL_MAX_MSG_HANDLES, MaxNumHandles)];
+    {{- end }}
+    ::fidl::OutgoingMessage message(::fidl::OutgoingMessage::ConstructorArgs{
+        .iovecs = iovecs,
+        .iovec_capacity = ::fidl::internal::IovecBufferSize,
+    {{- if gt .MaxHandles 0 }}
+        .handles = handles,
+        .handle_capacity = std::min(ZX_CHANNEL_MAX_MSG_HANDLES, MaxNumHandles),
+    {{- end }}
+        .backing_buffer = backing_buffer.data(),
+        .backing_buffer_capacity = static_cast<uint32_t>(backing_buffer.size()),
+    });
+    message.Encode<{{ .Name }}>(this);
+    if (!message.ok()) {
+      return message.status();
+    }
+    const fidl_outgoing_msg_t* raw = message.message();
+    for (uint32_t i = 0; i < raw->iovec.num_iovecs; ++i) {
+      builder.Append(raw->iovec.iovecs[i].buffer, raw->iovec.iovecs[i].capacity);
+    }
+    {{- if .IsResourceType }}
+    for (uint32_t i = 0; i < raw->iovec.num_handles; ++i) {
+      builder.AddHandle(raw->iovec.handles[i]);
+    }
+    message.ReleaseHandles();
+    {{- end }}
+    return ZX_OK;
+  }
+  {{- end }}
+
+  {{- if ExposeRaw }}
+
+  // UNSAFE: Returns the envelope of this union regardless of its tag, for
+  // custom codecs. The envelope is only meaningful together with the tag.
+  const {{ EnvelopeType }}& raw_envelope() const noexcept { return envelope_; }
+
+  // UNSAFE: Reinterprets |raw| in place as this union, which has the same
+  // layout. Returns nullptr if the ordinal of |raw| is not valid for this
+  // union. An absent union, with ordinal 0, is valid.
+  static {{ .Name }}* FromRaw(fidl_xunion_t* raw) {
+  {{- if .IsFlexible }}
+  {{- if UnknownMemberPolicy }}
+    // Any ordinal is valid, unless the unknown member policy rejects it.
+    {{ .Name }}* value = reinterpret_cast<{{ .Name }}*>(raw);
+    return value->HandleUnknownMember() == ZX_OK ? value : nullptr;
+  {{- else }}
+    // Any ordinal is valid: unknown ones are flexible unknown members.
+    return reinterpret_cast<{{ .Name }}*>(raw);
+  {{- end }}
+  {{- else }}
+    switch (raw->tag) {
+      case 0:
+    {{- range .Members }}
+      case {{ .Ordinal }}:
+    {{- end }}
+        return reinterpret_cast<{{ .Name }}*>(raw);
+      default:
+        return nullptr;
+    }
+  {{- end }}
+  }
+  {{- end }}
+
+  {{- if and .IsFlexible UnknownMemberPolicy }}
+
+  // Sets the policy that |HandleUnknownMember| applies to every |{{ .Name }}|.
+  // It is not synchronized: set it before decoding, e.g. at startup.
+  static void SetUnknownMemberPolicy(::fidl::UnknownMemberPolicy policy) {
+    unknown_member_policy_ = policy;
+  }
+
+  // Applies the unknown member policy to this union, typically right after
+  // decoding it. Returns ZX_ERR_NOT_SUPPORTED if the union holds an unknown
+  // member and the policy rejects it, and ZX_OK otherwise.
+  zx_status_t HandleUnknownMember() const {
+    if (has_invalid_tag() || which() != {{ .TagUnknown }}) {
+      return ZX_OK;
+    }
+    switch (unknown_member_policy_.action) {
+      case ::fidl::UnknownMemberAction::kPreserve:
+        return ZX_OK;
+      case ::fidl::UnknownMemberAction::kLog:
+        if (unknown_member_policy_.log != nullptr) {
+          unknown_member_policy_.log("{{ .TypeName }}", static_cast<fidl_xunion_tag_t>(ordinal_));
+        }
+        return ZX_OK;
+      case ::fidl::UnknownMemberAction::kReject:
+        return ZX_ERR_NOT_SUPPORTED;
+    }
+    // Not reached for the actions above. Keep the member for any other value.
+    return ZX_OK;
+  }
+  {{- end }}
+  {{- if .IsResourceType }}
+
+  void _CloseHandles();
+  {{- else }}
+  {{- if DeepCopy }}
+
+  // Returns a copy of this union whose member, including all of its
+  // out-of-line data, is allocated from |allocator|. This is useful to embed an
+  // existing union in a request. The bytes of unknown members are copied as is.
+  {{ .Name }} Clone(::fidl::AnyAllocator& allocator) const;
+
+  // Like |Clone|, but drops unknown members, returning a union with an
+  // invalid tag instead. This gives a canonical form for hashing and
+  // comparing values decoded by different versions of a protocol.
+  {{ .Name }} Canonicalize(::fidl::AnyAllocator& allocator) const;
+
+  // Returns a canonicalized copy of this union which owns its out-of-line
+  // data, so that it can outlive the arena this union was allocated from.
+  Owned{{ .Name }} ToOwned() const;
+  {{- end }}
+  {{- if StructuralComparison }}
+
+  // Like |StructurallyEqual|, but also accepts one of the unions having an
+  // invalid tag while the other holds a member with a default value, as when
+  // comparing a message from a version of the library which lacks the member
+  // with one from a version which has it.
+  bool CompatibleWith(const {{ .Name }}& other) const;
+  {{- end }}
+
+  {{- if AbslHash }}
+
+  // Hashes the ordinal and the value of the member of |value|, for Abseil
+  // hash containers. Unknown members are hashed by ordinal only.
+  template <typename H>
+  friend H AbslHashValue(H h, const {{ .Name }}& value) {
+    h = H::combine(std::move(h), static_cast<fidl_xunion_tag_t>(value.ordinal_));
+    switch (value.ordinal_) {
+    {{- range .Members }}
+      case {{ .WireOrdinalName }}: {
+        [[maybe_unused]] const auto& member = *static_cast<const {{ .Type }}*>(value.envelope_.data.get());
+        {{ AbslHashCombine "member" .Type }}
+        break;
+      }
+    {{- end }}
+      default:
+        break;
+    }
+    return h;
+  }
+  {{- end }}
+  {{- end }}
+
+ private:
+  enum class {{ .WireOrdinalEnum.Self }} : fidl_xunion_tag_t {
+    {{ .WireInvalidOrdinal.Self }} = 0,
+  {{- range .Members }}
+    {{ .WireOrdinalName.Self }} = {{ .Ordinal }},  // {{ .Ordinal | printf "%#x" }}
+  {{- end }}
+  };
+
+  static void SizeAndOffsetAssertionHelper();
+{{ "" }}
+  {{- if StructuralComparison }}
+  friend bool StructurallyEqual(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+  friend ::fidl::UnionDiff Diff(const {{ .Name }}& a, const {{ .Name }}& b);
+  {{- end }}
+  {{- if not .IsResourceType }}
+  {{- if StructuralComparison }}
+  friend bool operator<(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+  {{- end }}
+  {{- if FlatProjections }}
+  friend Flat{{ .Name }} Flatten(const {{ .Name }}& value);
+  {{- end }}
+  {{- end }}
+  {{- if EmitFidlText }}
+  friend std::string ToFidlText(const {{ .Name }}& value);
+  {{- end }}
+  {{- if and NaturalVariantUnions .HasNaturalVariant .HasExperimentalMembers }}
+  // Converts experimental members whatever FIDL_ALLOW_EXPERIMENTAL says.
+  friend class {{ .NaturalVariant }};
+  {{- end }}
+{{ "" }}
+  void MarkMovedFrom() {
+    envelope_ = {};
+    ordinal_ = {{ .WireInvalidOrdinal }};
+#ifndef NDEBUG
+    envelope_.data = ::fidl::ObjectView<void>::FromExternal(
+        reinterpret_cast<void*>(static_cast<uintptr_t>(0xfdfdfdfdfdfdfdfd)));
+#endif
+  }
+
+  {{- if AccessCoverage }}
+
+  // Counts the calls to the accessors of each member, and prints the counts
+  // to stderr at exit.
+  static inline std::array<std::atomic<uint64_t>, {{ len .Members }}> access_counts_;
+  struct AccessCoverageDumper {
+    ~AccessCoverageDumper() {
+    {{- range $index, $member := .Members }}
+      fprintf(stderr, "access coverage: {{ $.TypeName }}.{{ .Name }}: %llu\n",
+              static_cast<unsigned long long>(access_counts_[{{ $index }}].load()));
+    {{- end }}
+    }
+  };
+  static inline AccessCoverageDumper access_coverage_dumper_;
+  {{- end }}
+
+  {{- if and .IsFlexible UnknownMemberPolicy }}
+
+  static inline ::fidl::UnknownMemberPolicy unknown_member_policy_;
+  {{- end }}
+
+  {{- /* All fields are private to maintain standard layout */}}
+  {{ .WireOrdinalEnum }} ordinal_;
+  FIDL_ALIGNDECL
+  {{ EnvelopeType }} envelope_;
+};
+
+static_assert(std::is_nothrow_destructible_v<{{ .Name }}>, "{{ .Name }} must be safe to destroy in place");
+{{- if and .IsResourceType (ge HandleBudget 0) }}
+static_assert({{ .Name }}::MaxNumHandles <= {{ HandleBudget }},
+              "{{ .Name }} may carry more handles than the budget of {{ HandleBudget }}");
 {{- end }}
+{{- if StructuralComparison }}
 
-{{/* TODO(fxbug.dev/36441): Remove __Fuchsia__ ifdefs once we have non-Fuchsia
-     emulated handles for C++. */}}
-{{- define "UnionDeclaration" }}
-{{ EnsureNamespace . }}
-{{ if .IsResourceType }}
-{{- IfdefFuchsia -}}
+// Compares the tags and values of |lhs| and |rhs| recursively. Handles are compared
+// by presence only, so that values holding different handles compare equal.
+bool StructurallyEqual(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+
+// Reports whether |a| and |b| hold different members, or else whether their
+// values differ according to |StructurallyEqual|.
+::fidl::UnionDiff Diff(const {{ .Name }}& a, const {{ .Name }}& b);
 {{- end }}
-extern "C" const fidl_type_t {{ .CodingTableType }};
+{{- if Coalesce }}
+
+// Returns the first of |unions| with a valid tag, or the last of them if none
+// has one, as when resolving layered configuration. |unions| must not be
+// empty.
+const {{ .Name }}& Coalesce(std::initializer_list<std::reference_wrapper<const {{ .Name }}>> unions);
+{{- end }}
+{{- if ArenaBackedUnions }}
+
+// A |{{ .Name }}| together with the arena that backs its out-of-line data, so
+// that the two share one lifetime and can be moved around together. The arena
+// is heap allocated, so that moving the pair does not move the data. Members
+// should only be set from |arena()|, or from data that outlives the pair.
+class ArenaBacked{{ .Name }} {
+ public:
+  ArenaBacked{{ .Name }}() : arena_(std::make_unique<::fidl::FidlAllocator<>>()) {}
+  ArenaBacked{{ .Name }}(ArenaBacked{{ .Name }}&&) = default;
+  ArenaBacked{{ .Name }}& operator=(ArenaBacked{{ .Name }}&&) = default;
+
+  // Returns the arena, for setting members of |value()|.
+  ::fidl::AnyAllocator& arena() { return *arena_; }
+
+  {{ .Name }}& value() { return value_; }
+  const {{ .Name }}& value() const { return value_; }
+  {{ .Name }}& operator*() { return value_; }
+  const {{ .Name }}& operator*() const { return value_; }
+  {{ .Name }}* operator->() { return &value_; }
+  const {{ .Name }}* operator->() const { return &value_; }
+
+ private:
+  std::unique_ptr<::fidl::FidlAllocator<>> arena_;
+  {{ .Name }} value_;
+};
+{{- end }}
+{{- if SetOnce }}
+
+// A |{{ .Name }}| which may only be set once, e.g. for configuration that must
+// not change after initialization. Setting a member of a |SetOnce{{ .Name }}|
+// which was already set aborts.
+class SetOnce{{ .Name }} {
+ public:
+  SetOnce{{ .Name }}() = default;
+  SetOnce{{ .Name }}(SetOnce{{ .Name }}&&) = default;
+  SetOnce{{ .Name }}& operator=(SetOnce{{ .Name }}&&) = delete;
+  {{- range .Members }}
+{{ "" }}
+  {{- if .IsExperimental }}
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ private:
+#endif
+  {{- end }}
+  template <typename... Args>
+  {{- if .Validator }}
+  // The union still counts as unset if |{{ .Validator }}| rejects the value.
+  [[nodiscard]] zx_status_t set_{{ .Name }}(Args&&... args) {
+    ZX_ASSERT_MSG(!was_set_, "set_{{ .Name }}() called on a SetOnce{{ $.Name }} which was already set");
+    zx_status_t status = value_.set_{{ .Name }}(std::forward<Args>(args)...);
+    was_set_ = status == ZX_OK;
+    return status;
+  }
+  {{- else }}
+  void set_{{ .Name }}(Args&&... args) {
+    ZX_ASSERT_MSG(!was_set_, "set_{{ .Name }}() called on a SetOnce{{ $.Name }} which was already set");
+    value_.set_{{ .Name }}(std::forward<Args>(args)...);
+    was_set_ = true;
+  }
+  {{- end }}
+  {{- if .IsExperimental }}
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ public:
+#endif
+  {{- end }}
+  {{- end }}
+
+  bool was_set() const { return was_set_; }
+
+  const {{ .Name }}& value() const { return value_; }
+  const {{ .Name }}& operator*() const { return value_; }
+  const {{ .Name }}* operator->() const { return &value_; }
+
+ private:
+  {{ .Name }} value_;
+  bool was_set_ = false;
+};
+{{- end }}
+{{- if LazyUnions }}
+
+// A |{{ .Name }}| together with the allocator its members are allocated from,
+// for unions which are often constructed but seldom set. Nothing is allocated
+// until a member is first set, and setters do not take an allocator. The
+// allocator must outlive the |Lazy{{ .Name }}|.
+class Lazy{{ .Name }} {
+ public:
+  explicit Lazy{{ .Name }}(::fidl::AnyAllocator& allocator) : allocator_(&allocator) {}
+  Lazy{{ .Name }}(Lazy{{ .Name }}&&) = default;
+  Lazy{{ .Name }}& operator=(Lazy{{ .Name }}&&) = default;
+  {{- range .Members }}
+{{ "" }}
+  {{- if .IsExperimental }}
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ private:
+#endif
+  {{- end }}
+  template <typename... Args>
+  {{- if .Validator }}
+  [[nodiscard]] zx_status_t set_{{ .Name }}(Args&&... args) {
+    return value_.set_{{ .Name }}(*allocator_, std::forward<Args>(args)...);
+  }
+  {{- else }}
+  void set_{{ .Name }}(Args&&... args) {
+    value_.set_{{ .Name }}(*allocator_, std::forward<Args>(args)...);
+  }
+  {{- end }}
+  {{- if .IsExperimental }}
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ public:
+#endif
+  {{- end }}
+  {{- end }}
+
+  // Returns the allocator members are set from.
+  ::fidl::AnyAllocator& allocator() const { return *allocator_; }
+
+  {{ .Name }}& value() { return value_; }
+  const {{ .Name }}& value() const { return value_; }
+  {{ .Name }}& operator*() { return value_; }
+  const {{ .Name }}& operator*() const { return value_; }
+  {{ .Name }}* operator->() { return &value_; }
+  const {{ .Name }}* operator->() const { return &value_; }
+
+ private:
+  ::fidl::AnyAllocator* allocator_;
+  {{ .Name }} value_;
+};
+{{- end }}
+{{- if not .IsResourceType }}
+{{- if StructuralComparison }}
+
+// Orders unions by ordinal, then by the value of their member, so that they
+// can be sorted or stored in ordered containers. Unknown members with the
+// same ordinal are equivalent.
+bool operator<(const {{ .Name }}& lhs, const {{ .Name }}& rhs);
+{{- end }}
+{{- if DeepCopy }}
+
+// A |{{ .Name }}| together with a heap allocated arena holding all of its
+// out-of-line data. Obtained from |{{ .Name }}::ToOwned|.
+class Owned{{ .Name }} {
+ public:
+  Owned{{ .Name }}(Owned{{ .Name }}&&) = default;
+  Owned{{ .Name }}& operator=(Owned{{ .Name }}&&) = default;
+
+  const {{ .Name }}& value() const { return value_; }
+  const {{ .Name }}& operator*() const { return value_; }
+  const {{ .Name }}* operator->() const { return &value_; }
+
+ private:
+  friend class {{ .Name }};
+  friend class Cow{{ .Name }};
+
+  Owned{{ .Name }}() : allocator_(std::make_unique<::fidl::FidlAllocator<>>()) {}
+
+  std::unique_ptr<::fidl::FidlAllocator<>> allocator_;
+  {{ .Name }} value_;
+};
+
+// A copy-on-write |Owned{{ .Name }}|: copies share one reference counted
+// value until |mutable_value| is called on a copy which is not the only
+// holder, which then takes a copy of its own, as by |ToOwned|. Copies may be
+// used from different threads, but a copy must not be mutated while it is
+// being copied.
+class Cow{{ .Name }} {
+ public:
+  explicit Cow{{ .Name }}(Owned{{ .Name }} owned)
+      : owned_(std::make_shared<Owned{{ .Name }}>(std::move(owned))) {}
+
+  const {{ .Name }}& value() const { return owned_->value_; }
+  const {{ .Name }}& operator*() const { return owned_->value_; }
+  const {{ .Name }}* operator->() const { return &owned_->value_; }
+
+  // Returns the value for modification, after copying it if it is shared.
+  {{ .Name }}& mutable_value() {
+    if (owned_.use_count() != 1) {
+      owned_ = std::make_shared<Owned{{ .Name }}>(owned_->value_.ToOwned());
+    }
+    return owned_->value_;
+  }
+
+  // Returns the allocator holding the out-of-line data of the value, for
+  // setting members through |mutable_value|.
+  ::fidl::AnyAllocator& allocator() {
+    mutable_value();
+    return *owned_->allocator_;
+  }
+
+ private:
+  std::shared_ptr<Owned{{ .Name }}> owned_;
+};
+{{- end }}
+{{- if FlatProjections }}
+
+// A flat projection of |{{ .Name }}| for columnar storage. |tag| holds the
+// ordinal of the active member, or zero if there is none, and only the column
+// of the active member, if it is known, has a value. Strings and vectors still
+// refer to the out-of-line data of the union.
+struct Flat{{ .Name }} {
+  fidl_xunion_tag_t tag = 0;
+  {{- range .Members }}
+  cpp17::optional<{{ .Type }}> {{ .Name }};
+  {{- end }}
+};
+
+// Projects |value| into a |Flat{{ .Name }}|.
+Flat{{ .Name }} Flatten(const {{ .Name }}& value);
+{{- end }}
+{{- range UnionConversions . }}
+
+// Converts |src| to the structurally identical |{{ .Target }}|, copying the
+// member, including the contents of its strings and vectors, into |allocator|.
+// Unknown members are dropped
+{{- if $.HasExperimentalMembers }}, and so are experimental members, whatever
+// FIDL_ALLOW_EXPERIMENTAL says
+{{- end }}.
+{{ .Target }} {{ .FunctionName }}(::fidl::AnyAllocator& allocator, const {{ $.Name }}& src);
+{{- end }}
+{{- end }}
+{{- if EmitFidlText }}
+
+// Renders |value| in the FIDL text format, for golden tests.
+std::string ToFidlText(const {{ .Name }}& value);
+{{- end }}
+
+{{- if .IsResourceType }}
+{{- EndifFuchsia -}}
+{{- if HostStub }}
+{{ template "UnionHostStubDeclaration" . }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+{{- define "UnionHostStubDeclaration" }}
+#ifndef __Fuchsia__
 {{ .Docs }}
+// HOST STUB: handles are replaced by inert |zx_handle_t| values that are never
+// duplicated or closed. This type cannot be encoded or decoded.
 class {{ .Name }} {
   public:
   {{ .Name }}() : ordinal_({{ .WireInvalidOrdinal }}), envelope_{} {}
 
-  {{ .Name }}(const {{ .Name }}&) = default;
-  {{ .Name }}& operator=(const {{ .Name }}&) = default;
-  {{ .Name }}({{ .Name }}&&) = default;
-  {{ .Name }}& operator=({{ .Name }}&&) = default;
-
   enum class {{ .TagEnum.Self }} : fidl_xunion_tag_t {
   {{- range .Members }}
     {{ .TagName.Self }} = {{ .Ordinal }},  // {{ .Ordinal | printf "%#x" }}
@@ -37,70 +1581,69 @@ class {{ .Name }} {
   {{- end }}
   };
 
-  bool has_invalid_tag() const { return ordinal_ == {{ .WireInvalidOrdinal }}; }
+  // Returns the name of the member selected by |tag|, or an empty string for
+  // a tag that names no member. Usable in constant expressions.
+  static constexpr std::string_view TagName({{ .TagEnum.Self }} tag) noexcept {
+    switch (tag) {
+    {{- range .Members }}
+      case {{ $.TagEnum.Self }}::{{ .TagName.Self }}:
+        return "{{ .Name }}";
+    {{- end }}
+      default:
+        return "";
+    }
+  }
 
-  {{- range $index, $member := .Members }}
+  bool has_invalid_tag() const noexcept { return ordinal_ == {{ .WireInvalidOrdinal }}; }
 
-  bool is_{{ .Name }}() const { return ordinal_ == {{ .WireOrdinalName }}; }
+  // Returns the ordinal of the member held by this union, which may be
+  // unknown, or 0 if the tag is invalid. Unlike |which()|, it never asserts,
+  // for diagnostics of default constructed or malformed unions.
+  fidl_xunion_tag_t raw_ordinal() const noexcept { return static_cast<fidl_xunion_tag_t>(ordinal_); }
 
-  static {{ $.Name }} With{{ .UpperCamelCaseName }}(::fidl::ObjectView<{{ .Type }}> val) {
-    {{ $.Name }} result;
-    result.set_{{ .Name }}(val);
-    return result;
-  }
+  {{- range $member := .Members }}
 
-  template <typename... Args>
-  static {{ $.Name }} With{{ .UpperCamelCaseName }}(::fidl::AnyAllocator& allocator, Args&&... args) {
-    {{ $.Name }} result;
-    result.set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}>(allocator,
-                           std::forward<Args>(args)...));
-    return result;
-  }
+  bool is_{{ .Name }}() const noexcept { return ordinal_ == {{ .WireOrdinalName }}; }
+  {{- with $stub := .Type.WireHostStub }}
 {{ "" }}
-  {{- .Docs }}
-  void set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}> elem) {
-    ordinal_ = {{ .WireOrdinalName }};
+  {{- $member.Docs }}
+  void set_{{ $member.Name }}(::fidl::ObjectView<{{ $stub }}> elem) {
+    ordinal_ = {{ $member.WireOrdinalName }};
     envelope_.data = ::fidl::ObjectView<void>::FromExternal(static_cast<void*>(elem.get()));
   }
-
-  template <typename... Args>
-  void set_{{ .Name }}(::fidl::AnyAllocator& allocator, Args&&... args) {
-    ordinal_ = {{ .WireOrdinalName }};
-    set_{{ .Name }}(::fidl::ObjectView<{{ .Type }}>(allocator, std::forward<Args>(args)...));
-  }
-{{ "" }}
-  {{- .Docs }}
-  {{ .Type }}& mutable_{{ .Name }}() {
-    ZX_ASSERT(ordinal_ == {{ .WireOrdinalName }});
-    return *static_cast<{{ .Type }}*>(envelope_.data.get());
+  {{ $stub }}& mutable_{{ $member.Name }}(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()){{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+    {{ TagCheck $member.WireOrdinalName (printf "mutable_%s" $member.Name) $member.Name }}
+    return *static_cast<{{ $stub }}*>(envelope_.data.get());
   }
-  const {{ .Type }}& {{ .Name }}() const {
-    ZX_ASSERT(ordinal_ == {{ .WireOrdinalName }});
-    return *static_cast<{{ .Type }}*>(envelope_.data.get());
+  const {{ $stub }}& {{ $member.Name }}(const char* caller_file = __builtin_FILE(), int caller_line = __builtin_LINE()) const noexcept{{ if Lifetimebound }} FIDL_LIFETIMEBOUND{{ end }} {
+    {{ TagCheck $member.WireOrdinalName $member.Name $member.Name }}
+    return *static_cast<{{ $stub }}*>(envelope_.data.get());
   }
   {{- end }}
+  {{- end }}
 
+  {{ .TagEnum.Self }} which() const noexcept {
+    ZX_ASSERT(!has_invalid_tag());
   {{- if .IsFlexible }}
-  {{ .TagEnum }} which() const;
+    switch (ordinal_) {
+    {{- range .Members }}
+    case {{ .WireOrdinalName }}:
+    {{- end }}
+      return static_cast<{{ .TagEnum.Self }}>(ordinal_);
+    default:
+      return {{ .TagEnum.Self }}::{{ .TagUnknown.Self }};
+    }
   {{- else }}
-  {{ .TagEnum }} which() const {
-    ZX_ASSERT(!has_invalid_tag());
-    return static_cast<{{ .TagEnum }}>(ordinal_);
-  }
+    return static_cast<{{ .TagEnum.Self }}>(ordinal_);
   {{- end }}
+  }
 
-  static constexpr const fidl_type_t* Type = &{{ .CodingTableType }};
   static constexpr uint32_t MaxNumHandles = {{ .MaxHandles }};
   static constexpr uint32_t PrimarySize = {{ .InlineSize }};
   [[maybe_unused]]
   static constexpr uint32_t MaxOutOfLine = {{ .MaxOutOfLine }};
   static constexpr bool HasPointer = {{ .HasPointer }};
 
-  {{- if .IsResourceType }}
-
-  void _CloseHandles();
-  {{- end }}
-
  private:
   enum class {{ .WireOrdinalEnum.Self }} : fidl_xunion_tag_t {
     {{ .WireInvalidOrdinal.Self }} = 0,
@@ -109,17 +1652,11 @@ class {{ .Name }} {
   {{- end }}
   };
 
-  static void SizeAndOffsetAssertionHelper();
-
-  {{- /* All fields are private to maintain standard layout */}}
   {{ .WireOrdinalEnum }} ordinal_;
   FIDL_ALIGNDECL
-  ::fidl::Envelope<void> envelope_;
+  {{ EnvelopeType }} envelope_;
 };
-
-{{- if .IsResourceType }}
-{{- EndifFuchsia -}}
-{{- end }}
+#endif  // !__Fuchsia__
 {{- end }}
 
 {{/* TODO(fxbug.dev/36441): Remove __Fuchsia__ ifdefs once we have non-Fuchsia
@@ -129,7 +1666,7 @@ class {{ .Name }} {
 {{- IfdefFuchsia -}}
 {{- end }}
 {{- if .IsFlexible }}
-auto {{ . }}::which() const -> {{ .TagEnum }} {
+auto {{ . }}::which() const noexcept -> {{ .TagEnum }} {
   ZX_ASSERT(!has_invalid_tag());
   switch (ordinal_) {
   {{- range .Members }}
@@ -142,18 +1679,267 @@ auto {{ . }}::which() const -> {{ .TagEnum }} {
 }
 {{- end }}
 
+{{/* NOTE: Unions cannot hold extra state, even only in debug builds (such
+     as a construction timestamp, or a canary word next to the envelope to
+     catch overruns): they are encoded in place and must keep the size and
+     layout of fidl_xunion_t, in every build. Arena corruption is better caught
+     by building the arena with ASan poisoning between its blocks. */ -}}
 void {{ . }}::SizeAndOffsetAssertionHelper() {
   static_assert(sizeof({{ .Name }}) == sizeof(fidl_xunion_t));
   static_assert(offsetof({{ .Name }}, ordinal_) == offsetof(fidl_xunion_t, tag));
   static_assert(offsetof({{ .Name }}, envelope_) == offsetof(fidl_xunion_t, envelope));
+
+  // Catches the generated declaration drifting from the members in the IR:
+  // each must have an |Ordinal| entry, and be counted in |MemberCount|.
+  constexpr {{ .WireOrdinalEnum }} kOrdinals[] = {
+    {{ .WireInvalidOrdinal }},
+  {{- range .Members }}
+    {{ .WireOrdinalName }},
+  {{- end }}
+  };
+  static_assert(sizeof(kOrdinals) / sizeof(kOrdinals[0]) == MemberCount + 1);
+  static_assert(MemberCount == {{ len .Members }});
+}
+{{- if StructuralComparison }}
+
+bool {{ .Namespace }}::StructurallyEqual(const {{ . }}& lhs, const {{ . }}& rhs) {
+  if (lhs.ordinal_ != rhs.ordinal_) {
+    return false;
+  }
+  switch (lhs.ordinal_) {
+  {{- range .Members }}
+    case {{ .WireOrdinalName }}: {
+      {{ StructurallyEqual (printf "lhs.%s()" .Name) (printf "rhs.%s()" .Name) .Type }}
+      break;
+    }
+  {{- end }}
+  default:
+    break;
+  }
+  return true;
+}
+
+auto {{ .Namespace }}::Diff(const {{ . }}& a, const {{ . }}& b) -> ::fidl::UnionDiff {
+  ::fidl::UnionDiff diff;
+  diff.tag_changed = a.ordinal_ != b.ordinal_;
+  diff.value_changed = !diff.tag_changed && !StructurallyEqual(a, b);
+  return diff;
+}
+{{- end }}
+{{- if Coalesce }}
+
+auto {{ .Namespace }}::Coalesce(std::initializer_list<std::reference_wrapper<const {{ . }}>> unions)
+    -> const {{ . }}& {
+  ZX_ASSERT(unions.size() != 0);
+  for (const {{ . }}& u : unions) {
+    if (!u.has_invalid_tag()) {
+      return u;
+    }
+  }
+  return (unions.end() - 1)->get();
+}
+{{- end }}
+{{- if not .IsResourceType }}
+{{- if StructuralComparison }}
+
+bool {{ . }}::CompatibleWith(const {{ . }}& other) const {
+  if (ordinal_ == other.ordinal_) {
+    return StructurallyEqual(*this, other);
+  }
+  if (!has_invalid_tag() && !other.has_invalid_tag()) {
+    return false;
+  }
+  const {{ . }}& present = has_invalid_tag() ? other : *this;
+  switch (present.ordinal_) {
+  {{- range .Members }}
+    case {{ .WireOrdinalName }}: {
+      const {{ .Type }} kDefault{};
+      {{ StructurallyEqual (printf "present.%s()" .Name) "kDefault" .Type }}
+      return true;
+    }
+  {{- end }}
+  default:
+    // The value of an unknown member cannot be checked.
+    return false;
+  }
+}
+
+bool {{ .Namespace }}::operator<(const {{ . }}& lhs, const {{ . }}& rhs) {
+  if (lhs.ordinal_ != rhs.ordinal_) {
+    return lhs.ordinal_ < rhs.ordinal_;
+  }
+  switch (lhs.ordinal_) {
+  {{- range .Members }}
+    case {{ .WireOrdinalName }}: {
+      {{ LessThan (printf "lhs.%s()" .Name) (printf "rhs.%s()" .Name) .Type }}
+      break;
+    }
+  {{- end }}
+  default:
+    break;
+  }
+  return false;
+}
+{{- end }}
+{{- if FlatProjections }}
+
+auto {{ .Namespace }}::Flatten(const {{ . }}& value) -> {{ .Namespace }}::Flat{{ .Name }} {
+  Flat{{ .Name }} flat;
+  flat.tag = static_cast<fidl_xunion_tag_t>(value.ordinal_);
+  switch (value.ordinal_) {
+  {{- range .Members }}
+    case {{ .WireOrdinalName }}:
+      flat.{{ .Name }} = value.{{ .Name }}();
+      break;
+  {{- end }}
+    default:
+      break;
+  }
+  return flat;
+}
+{{- end }}
+{{- end }}
+
+{{- if EmitFidlText }}
+
+auto {{ .Namespace }}::ToFidlText(const {{ . }}& value) -> std::string {
+  std::string out = "{{ .Name }} {";
+  switch (value.ordinal_) {
+  {{- range .Members }}
+    case {{ .WireOrdinalName }}:
+      out += " {{ .Name }}: ";
+      {{ FidlText (printf "value.%s()" .Name) .Type }}
+      out += " ";
+      break;
+  {{- end }}
+    case {{ .WireInvalidOrdinal }}:
+      break;
+    default:
+      out += " <unknown ordinal " + std::to_string(static_cast<uint64_t>(value.ordinal_)) + "> ";
+      break;
+  }
+  out += "}";
+  return out;
+}
+{{- end }}
+
+{{- if not .IsResourceType }}
+{{- if DeepCopy }}
+
+auto {{ . }}::Clone(::fidl::AnyAllocator& allocator) const -> {{ . }} {
+  {{ . }} result;
+  {{- $set := "" }}
+  switch (ordinal_) {
+  {{- range .Members }}
+    case {{ .WireOrdinalName }}: {
+      {{- if SimdAlignment .Type }}
+      {{- /* Only set_x(allocator, ...) allocates at the SIMD alignment. */}}
+      {{ .Type }} value{};
+      {{ CloneValue "value" (printf "%s()" .Name) .Type }}
+      {{- $set = printf "result.set_%s(allocator, std::move(value))" .Name }}
+      {{- else }}
+      ::fidl::ObjectView<{{ .Type }}> value(allocator);
+      {{ CloneValue "(*value)" (printf "%s()" .Name) .Type }}
+      {{- $set = printf "result.set_%s(value)" .Name }}
+      {{- end }}
+      {{- if .Validator }}
+      zx_status_t status = {{ $set }};
+      ZX_ASSERT_MSG(status == ZX_OK, "{{ .Validator }} rejected the value of |{{ .Name }}|");
+      {{- else }}
+      {{ $set }};
+      {{- end }}
+      break;
+    }
+  {{- end }}
+    default:
+      {{- /* Unknown members of value unions hold no handles, and their bytes
+             include their out-of-line data. */}}
+      result.ordinal_ = ordinal_;
+      result.envelope_ = envelope_;
+      if (envelope_.num_bytes != 0) {
+        ::fidl::VectorView<uint8_t> bytes(allocator, envelope_.num_bytes);
+        memcpy(bytes.mutable_data(), envelope_.data.get(), envelope_.num_bytes);
+        result.envelope_.data =
+            ::fidl::ObjectView<void>::FromExternal(static_cast<void*>(bytes.mutable_data()));
+      }
+      break;
+  }
+  return result;
+}
+
+auto {{ . }}::Canonicalize(::fidl::AnyAllocator& allocator) const -> {{ . }} {
+  switch (ordinal_) {
+  {{- range .Members }}
+    case {{ .WireOrdinalName }}:
+  {{- end }}
+      return Clone(allocator);
+    default:
+      return {{ . }}();
+  }
+}
+
+auto {{ . }}::ToOwned() const -> {{ .Namespace }}::Owned{{ .Name }} {
+  {{ .Namespace }}::Owned{{ .Name }} owned;
+  owned.value_ = Canonicalize(*owned.allocator_);
+  return owned;
+}
+{{- end }}
+{{- range $conversion := UnionConversions . }}
+
+auto {{ $.Namespace }}::{{ $conversion.FunctionName }}(::fidl::AnyAllocator& allocator, const {{ $ }}& src)
+    -> {{ $conversion.Target }} {
+  {{ $conversion.Target }} result;
+  if (src.has_invalid_tag()) {
+    return result;
+  }
+  {{- $set := "" }}
+  switch (src.which()) {
+  {{- range $.Members }}
+  {{- if not .IsExperimental }}
+    case {{ .TagName }}: {
+      {{- if SimdAlignment .Type }}
+      {{ .Type }} value{};
+      {{ CloneValue "value" (printf "src.%s()" .Name) .Type }}
+      {{- $set = printf "result.set_%s(allocator, std::move(value))" .Name }}
+      {{- else }}
+      ::fidl::ObjectView<{{ .Type }}> value(allocator);
+      {{ CloneValue "(*value)" (printf "src.%s()" .Name) .Type }}
+      {{- $set = printf "result.set_%s(value)" .Name }}
+      {{- end }}
+      {{- /* The members of the target may have validators of their own. */}}
+      if constexpr (std::is_void_v<decltype({{ $set }})>) {
+        {{ $set }};
+      } else {
+        zx_status_t status = {{ $set }};
+        ZX_ASSERT_MSG(status == ZX_OK, "{{ $conversion.Target }} rejected the value of |{{ .Name }}|");
+      }
+      break;
+    }
+  {{- end }}
+  {{- end }}
+    default:
+      break;
+  }
+  return result;
 }
+{{- end }}
+{{- end }}
 
 {{- if .IsResourceType }}
 void {{ . }}::_CloseHandles() {
+  {{- if DestructorHook }}
+  if (OnUnionDestroyed != nullptr) {
+    OnUnionDestroyed("{{ .TypeName }}");
+  }
+  {{- end }}
   switch (ordinal_) {
   {{- range .Members }}
     {{- if .Type.IsResource }}
       case {{ .WireOrdinalName }}: {
+        {{- if TraceHandles }}
+        TRACE_INSTANT("fidl", "UnionCloseHandles", TRACE_SCOPE_THREAD, "union", "{{ $.TypeName }}",
+                      "member", "{{ .Name }}");
+        {{- end }}
         {{- CloseHandles . false true }}
         break;
       }
@@ -172,6 +1958,25 @@ void {{ . }}::_CloseHandles() {
 
 {{/* TODO(fxbug.dev/36441): Remove __Fuchsia__ ifdefs once we have non-Fuchsia
      emulated handles for C++. */}}
+{{- define "UnionTupleTraits" }}
+{{ if .IsResourceType }}
+{{- IfdefFuchsia -}}
+{{- end }}
+template <>
+struct tuple_size<{{ . }}> : public std::integral_constant<size_t, 2> {};
+template <>
+struct tuple_element<0, {{ . }}> {
+  using type = {{ .TagEnum }};
+};
+template <>
+struct tuple_element<1, {{ . }}> {
+  using type = {{ . }}::ActiveMember;
+};
+{{- if .IsResourceType }}
+{{- EndifFuchsia -}}
+{{- end }}
+{{- end }}
+
 {{- define "UnionTraits" }}
 {{ if .IsResourceType }}
 {{- IfdefFuchsia -}}
@@ -180,6 +1985,10 @@ template <>
 struct IsFidlType<{{ . }}> : public std::true_type {};
 template <>
 struct IsUnion<{{ . }}> : public std::true_type {};
+// The union only holds its ordinal and a pointer to the active member, which
+// does not move, so it is relocatable whatever the types of its members.
+template <>
+struct IsRelocatable<{{ . }}> : public std::true_type {};
 static_assert(std::is_standard_layout_v<{{ . }}>);
 {{- if .IsResourceType }}
 {{- EndifFuchsia -}}
@@ -0,0 +1,154 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package codegen
+
+const fragmentUnionNaturalTmpl = `
+{{- define "UnionNaturalDeclaration" }}
+{{ EnsureNamespace .NaturalVariant }}
+{{ if .IsResourceType }}
+{{- IfdefFuchsia -}}
+{{- end }}
+// Holds the active member of |{{ .Wire }}| by value in a std::variant,
+// so that it can be {{ if not .IsResourceType }}copied, {{ end }}moved and stored without an arena: strings,
+// vectors and nested unions are held as std::string, std::vector and their
+// natural variants, which own their data.
+{{- if .IsFlexible }}
+// Unknown members are dropped when converting from the wire union.
+{{- end }}
+class {{ .NaturalVariant.Self }} {
+ public:
+  using Storage = std::variant<
+  {{- range .Members }}
+      {{ .NaturalType }},
+  {{- end }}
+      std::monostate>;
+
+  {{ .NaturalVariant.Self }}() = default;
+  explicit {{ .NaturalVariant.Self }}(Storage storage) : storage_(std::move(storage)) {}
+  {{- if .IsResourceType }}
+  {{ .NaturalVariant.Self }}(const {{ .NaturalVariant.Self }}&) = delete;
+  {{ .NaturalVariant.Self }}& operator=(const {{ .NaturalVariant.Self }}&) = delete;
+  {{- else }}
+  {{ .NaturalVariant.Self }}(const {{ .NaturalVariant.Self }}&) = default;
+  {{ .NaturalVariant.Self }}& operator=(const {{ .NaturalVariant.Self }}&) = default;
+  {{- end }}
+  {{ .NaturalVariant.Self }}({{ .NaturalVariant.Self }}&&) = default;
+  {{ .NaturalVariant.Self }}& operator=({{ .NaturalVariant.Self }}&&) = default;
+
+  {{- if .IsResourceType }}
+
+  // Takes the active member, and its handles, out of |wire|.
+  {{- if .HasCapabilityMembers }} |token| grants
+  // access to the members that require it.
+  static {{ .NaturalVariant.Self }} FromWire({{ .Wire }}&& wire, {{ .Wire }}::CapabilityToken token) {
+  {{- else }}
+  static {{ .NaturalVariant.Self }} FromWire({{ .Wire }}&& wire) {
+  {{- end }}
+  {{- else }}
+
+  static {{ .NaturalVariant.Self }} FromWire(const {{ .Wire }}& wire) {
+  {{- end }}
+    {{ .NaturalVariant.Self }} result;
+    if (wire.has_invalid_tag()) {
+      return result;
+    }
+    switch (wire.which()) {
+    {{- range $index, $member := .Members }}
+      case {{ .TagName }}: {
+        {{- if $.IsResourceType }}
+        auto& value = wire.mutable_{{ .Name }}({{ if .RequiresCap }}token{{ end }});
+        {{- else }}
+        const auto& value = wire.{{ .Name }}();
+        {{- end }}
+        auto& member = result.storage_.emplace<{{ $index }}>();
+        {{ NaturalFromWire "member" "value" .Type }}
+        break;
+      }
+    {{- end }}
+      default:
+        break;
+    }
+    return result;
+  }
+
+  {{- if .IsResourceType }}
+
+  // Moves the active member, and its handles, into a wire union whose
+  // out-of-line data is allocated from |allocator|.
+  {{ .Wire }} ToWire(::fidl::AnyAllocator& allocator) && {
+  {{- else }}
+
+  // Copies the active member into a wire union whose out-of-line data is
+  // allocated from |allocator|.
+  {{ .Wire }} ToWire(::fidl::AnyAllocator& allocator) const {
+  {{- end }}
+    {{ .Wire }} wire;
+    switch (storage_.index()) {
+    {{- range $index, $member := .Members }}
+      case {{ $index }}: {
+        {{ .Type }} value{};
+        {{ NaturalToWire "value" (printf "std::get<%d>(storage_)" $index) .Type }}
+        {{- if .Validator }}
+        zx_status_t status = wire.set_{{ .Name }}(allocator, std::move(value));
+        ZX_ASSERT_MSG(status == ZX_OK, "{{ .Validator }} rejected the value of |{{ .Name }}|");
+        {{- else }}
+        wire.set_{{ .Name }}(allocator, std::move(value));
+        {{- end }}
+        break;
+      }
+    {{- end }}
+      default:
+        break;
+    }
+    return wire;
+  }
+
+  bool has_invalid_tag() const { return storage_.index() == {{ len .Members }}; }
+
+  {{- range $index, $member := .Members }}
+  {{- if .IsExperimental }}
+
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ private:
+#endif
+  {{- end }}
+
+  bool is_{{ .Name }}() const { return storage_.index() == {{ $index }}; }
+  void set_{{ .Name }}({{ .NaturalType }} value) { storage_.emplace<{{ $index }}>(std::move(value)); }
+  {{- if .RequiresCap }}
+  {{ .NaturalType }}& {{ .Name }}({{ $.Wire }}::CapabilityToken) { return std::get<{{ $index }}>(storage_); }
+  const {{ .NaturalType }}& {{ .Name }}({{ $.Wire }}::CapabilityToken) const {
+    return std::get<{{ $index }}>(storage_);
+  }
+  {{- else }}
+  {{ .NaturalType }}& {{ .Name }}() { return std::get<{{ $index }}>(storage_); }
+  const {{ .NaturalType }}& {{ .Name }}() const { return std::get<{{ $index }}>(storage_); }
+  {{- end }}
+  {{- if .IsExperimental }}
+#ifndef FIDL_ALLOW_EXPERIMENTAL
+ public:
+#endif
+  {{- end }}
+  {{- end }}
+
+  // The members are in declaration order, followed by std::monostate when the
+  // tag is invalid, for use with std::visit.
+  {{- if .HasCapabilityMembers }} This exposes every member, so it
+  // takes a |CapabilityToken| too.
+  Storage& storage({{ .Wire }}::CapabilityToken) { return storage_; }
+  const Storage& storage({{ .Wire }}::CapabilityToken) const { return storage_; }
+  {{- else }}
+  Storage& storage() { return storage_; }
+  const Storage& storage() const { return storage_; }
+  {{- end }}
+
+ private:
+  Storage storage_{std::in_place_index<{{ len .Members }}>};
+};
+{{- if .IsResourceType }}
+{{- EndifFuchsia -}}
+{{- end }}
+{{- end }}
+`
@@ -16,7 +16,51 @@ import (
 
 type flagsDef struct {
 	cpp.CommonFlags
-	testBase *string
+	testBase             *string
+	taggedEnvelope       *string
+	sortMembersByOrdinal *bool
+	hostStub             *bool
+	zeroUnionPadding     *bool
+	warnSingleMember     *bool
+	byValueGetterMaxSize *int
+	destructorHook       *bool
+	exposeRaw            *bool
+	accessCoverage       *bool
+	emitFidlText         *bool
+	naturalVariantUnions *bool
+	rangeCompat          *bool
+	uniformPresence      *bool
+	abslHash             *bool
+	lenientGetters       *bool
+	unionConversions     *string
+	docOut               *string
+	fitResultGetters     *bool
+	moduleInterface      *string
+	emitCompatTest       *string
+	lifetimebound        *bool
+	storagePolicy        *string
+	maxHandles           *int
+	arenaBackedUnions    *bool
+	lazyUnions           *bool
+	layoutComments       *bool
+	compatAgainst        *string
+	assertMacro          *string
+	traceHandles         *bool
+	unknownMemberPolicy  *bool
+	flatProjections      *bool
+	hardened             *bool
+	simdAlign            *int
+	setOnce              *bool
+	testHelpers          *bool
+	allocationReport     *bool
+	structuralComparison *bool
+	deepCopy             *bool
+	typeErasedSet        *bool
+	unionIntrospection   *bool
+	unionEncode          *bool
+	structuredBindings   *bool
+	coalesce             *bool
+	wireFormat           *string
 }
 
 var _ cpp.CodegenOptions = (*flagsDef)(nil)
@@ -52,6 +96,137 @@ var flags = flagsDef{
 	},
 	testBase: flag.String("test-base", "",
 		"the output path for the generated test base header."),
+	taggedEnvelope: flag.String("tagged-envelope", "",
+		"[optional] synthesize a flexible union wrapping top-level declarations, "+
+			"of the form Name=Decl1,Decl2,..."),
+	sortMembersByOrdinal: flag.Bool("sort-members-by-ordinal", false,
+		"[optional] emit union members in ordinal order instead of declaration order."),
+	hostStub: flag.Bool("host-stub", false,
+		"[optional] emit host stubs of resource unions, with handles replaced by "+
+			"inert zx_handle_t values."),
+	zeroUnionPadding: flag.Bool("zero-union-padding", false,
+		"[optional] zero the whole primary object of unions when default-constructing them "+
+			"in debug builds, for static analyzers which assume they have padding."),
+	warnSingleMember: flag.Bool("warn-single-member-union", false,
+		"[optional] warn about unions with a single member."),
+	byValueGetterMaxSize: flag.Int("by-value-getter-max-size", 0,
+		"[optional] return primitive, bits and enum union members of up to this "+
+			"many bytes by value from their const getters."),
+	destructorHook: flag.Bool("destructor-hook", false,
+		"[optional] call the weak function OnUnionDestroyed before closing the "+
+			"handles of a resource union."),
+	exposeRaw: flag.Bool("expose-raw", false,
+		"[optional] add unsafe accessors to the underlying representation of unions."),
+	accessCoverage: flag.Bool("access-coverage", false,
+		"[optional] count calls to union member accessors and print the counts at exit."),
+	emitFidlText: flag.Bool("emit-fidl-text", false,
+		"[optional] generate ToFidlText() to render values in the FIDL text format."),
+	naturalVariantUnions: flag.Bool("natural-variant-unions", false,
+		"[optional] generate a std::variant backed natural::MyUnion, owning its data, "+
+			"for each union without struct or table members, with conversions to and from the wire union."),
+	rangeCompat: flag.Bool("range-compat", false,
+		"[optional] add begin() and end() to unions, ranging over the union when it has a valid tag."),
+	uniformPresence: flag.Bool("uniform-presence", false,
+		"[optional] add PresenceMask() to unions, using the bit layout of table presence bitmaps. "+
+			"Fails if a union has a member with an ordinal above 64."),
+	abslHash: flag.Bool("absl-hash", false,
+		"[optional] add an AbslHashValue friend to value unions, for use in Abseil hash containers."),
+	lenientGetters: flag.Bool("lenient-getters", false,
+		"[optional] add x_or_default() accessors to union members without handles, "+
+			"which log a warning instead of asserting on a tag mismatch."),
+	unionConversions: flag.String("union-conversions", "",
+		"[optional] comma separated Source=::target::wire::Target pairs, generating "+
+			"ConvertSourceToTarget() from each value union Source of the library, whose members "+
+			"must be primitives, strings, arrays or vectors, to the structurally identical wire "+
+			"union Target, matching members by name."),
+	docOut: flag.String("doc-out", "",
+		"[optional] the output path for a JSON file with the doc comments of each union and its members."),
+	fitResultGetters: flag.Bool("fit-result-getters", false,
+		"[optional] add x_result() accessors to union members, returning fit::failed on a tag mismatch."),
+	moduleInterface: flag.String("module-interface", "",
+		"[optional] the output path for a C++20 module interface unit exporting the "+
+			"bits, enums, structs, tables and unions of the library from the generated header."),
+	emitCompatTest: flag.String("emit-compat-test", "",
+		"[optional] the output path for a gtest checking each union member ordinal "+
+			"against its current value, to be checked in as a golden."),
+	lifetimebound: flag.Bool("lifetimebound", false,
+		"[optional] annotate union member reference getters with [[clang::lifetimebound]], "+
+			"so that calling them on a temporary union warns."),
+	storagePolicy: flag.String("storage-policy", "",
+		"[optional] the type that unions keep the out-of-line storage of their active "+
+			"member in, instead of ::fidl::Envelope<void>. It must have the layout of "+
+			"fidl_envelope_t, and a data member usable as a ::fidl::ObjectView<void>."),
+	maxHandles: flag.Int("max-handles", -1,
+		"[optional] fail the build, with a static_assert, if a resource union may carry "+
+			"more than this many handles. Negative values disable the check."),
+	arenaBackedUnions: flag.Bool("arena-backed-unions", false,
+		"[optional] generate ArenaBackedX classes, which hold a union X together with "+
+			"the arena backing its out-of-line data."),
+	lazyUnions: flag.Bool("lazy-unions", false,
+		"[optional] generate LazyX classes, which hold a union X together with the "+
+			"allocator its members are set from, and only allocate when one is set."),
+	layoutComments: flag.Bool("layout-comments", false,
+		"[optional] document the wire layout of each union in a comment above its "+
+			"declaration."),
+	compatAgainst: flag.String("compat-against", "",
+		"[optional] the JSON IR of a previous version of the library. Fails if a union "+
+			"member of that version lost its ordinal or changed its type."),
+	assertMacro: flag.String("assert-macro", "",
+		"[optional] the macro, called like assert, that union getters check that the "+
+			"union holds their member with, instead of ZX_ASSERT_MSG."),
+	traceHandles: flag.Bool("trace-handles", false,
+		"[optional] emit a trace event, naming the member, when a resource union is set "+
+			"to a member with handles or closes them."),
+	unknownMemberPolicy: flag.Bool("unknown-member-policy", false,
+		"[optional] add HandleUnknownMember() to flexible unions, which preserves, logs "+
+			"or rejects unknown members according to a policy set per union type."),
+	flatProjections: flag.Bool("flat-projections", false,
+		"[optional] generate Flatten() for value unions, projecting them into a flat "+
+			"struct with a tag column and one optional column per member."),
+	hardened: flag.Bool("hardened", false,
+		"[optional] make union getters abort if the out-of-line data of their member "+
+			"is outside of the bounds set by a fidl::HardenedMessageBounds."),
+	simdAlign: flag.Int("simd-align", 0,
+		"[optional] allocate union members which are arrays of floats at a multiple of "+
+			"this many bytes, a power of two, and generate aligned_x_data() accessors for them."),
+	setOnce: flag.Bool("set-once", false,
+		"[optional] generate SetOnceX wrappers for unions X, which abort when set a second time."),
+	testHelpers: flag.Bool("test-helpers", false,
+		"[optional] add AssertTag() to unions, for tests, which aborts with the name of "+
+			"the member a union holds when it is not the expected one."),
+	allocationReport: flag.Bool("allocation-report", false,
+		"[optional] add ReportAllocation() to unions, returning the bytes the member "+
+			"of a union occupies in its arena."),
+	structuralComparison: flag.Bool("structural-comparison", false,
+		"[optional] generate StructurallyEqual() and operator< for structs, tables "+
+			"and unions, and Diff() and CompatibleWith() for unions. The libraries "+
+			"this library depends on must be generated with it too."),
+	deepCopy: flag.Bool("deep-copy", false,
+		"[optional] generate Clone() for value structs, tables and unions, and "+
+			"Canonicalize(), ToOwned() and the OwnedX and CowX classes for value "+
+			"unions. The libraries this library depends on must be generated with "+
+			"it too."),
+	typeErasedSet: flag.Bool("type-erased-set", false,
+		"[optional] add Set(tag, value, allocator) to unions, which sets the "+
+			"member selected by tag from a std::any, for scripting bridges."),
+	unionIntrospection: flag.Bool("union-introspection", false,
+		"[optional] generate GetUnionRegistry(), which describes the unions of the "+
+			"library, the AnyUnion variant over them, MakeUnionByName() and the "+
+			"ListMembers() function of each union, for debugging and replay tools."),
+	unionEncode: flag.Bool("union-encode", false,
+		"[optional] add Encode() and EncodeToIovecs() to unions, which encode them "+
+			"without going through a channel, for custom transports, and "+
+			"AppendEncodedBytes() to value unions."),
+	structuredBindings: flag.Bool("structured-bindings", false,
+		"[optional] make unions usable in structured bindings, which bind their "+
+			"tag and active member, by adding get<I>() and specializing "+
+			"std::tuple_size and std::tuple_element for them."),
+	coalesce: flag.Bool("coalesce", false,
+		"[optional] generate a Coalesce() function for each union, which returns "+
+			"the first of several unions with a valid tag, for layered configuration."),
+	wireFormat: flag.String("wire-format", "v1",
+		"[optional] the wire format to generate unions for, which they expose as "+
+			"kWireFormat. Only v1 is supported."),
 }
 
 // valid returns true if the parsed flags are valid.
@@ -66,11 +241,64 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *flags.wireFormat != "v1" {
+		log.Fatalf("-wire-format must be v1, not %q", *flags.wireFormat)
+	}
+	if n := *flags.simdAlign; n < 0 || n&(n-1) != 0 {
+		log.Fatalf("-simd-align must be a power of two, not %d", n)
+	}
+
 	fidl, err := fidlgen.ReadJSONIr(*flags.Json)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *flags.compatAgainst != "" {
+		old, err := fidlgen.ReadJSONIr(*flags.compatAgainst)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := cpp.CheckUnionCompat(old, fidl); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *flags.warnSingleMember {
+		for _, name := range cpp.SingleMemberUnions(fidl) {
+			log.Printf("warning: union %s has a single member", name)
+		}
+	}
+
+	if *flags.taggedEnvelope != "" {
+		envelope, err := cpp.ParseTaggedEnvelope(*flags.taggedEnvelope)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if fidl, err = cpp.AddTaggedEnvelope(fidl, envelope); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *flags.sortMembersByOrdinal {
+		fidl = cpp.SortUnionMembersByOrdinal(fidl)
+	}
+
+	if *flags.uniformPresence {
+		if err := cpp.CheckUniformPresence(fidl); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var unionConversions []cpp.UnionConversion
+	if *flags.unionConversions != "" {
+		if unionConversions, err = cpp.ParseUnionConversions(*flags.unionConversions); err != nil {
+			log.Fatal(err)
+		}
+		if err := cpp.CheckUnionConversions(fidl, unionConversions); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	primaryHeader, err := cpp.CalcPrimaryHeader(flags, fidl.Name.Parts())
 	if err != nil {
 		log.Fatal(err)
@@ -81,7 +309,45 @@ func main() {
 		IncludeStem:   flags.IncludeStem(),
 	})
 
-	generator := codegen.NewGenerator()
+	generator := codegen.NewGenerator(codegen.Options{
+		HostStub:             *flags.hostStub,
+		ZeroUnionPadding:     *flags.zeroUnionPadding,
+		ByValueGetterMaxSize: *flags.byValueGetterMaxSize,
+		DestructorHook:       *flags.destructorHook,
+		ExposeRaw:            *flags.exposeRaw,
+		AccessCoverage:       *flags.accessCoverage,
+		EmitFidlText:         *flags.emitFidlText,
+		NaturalVariantUnions: *flags.naturalVariantUnions,
+		RangeCompat:          *flags.rangeCompat,
+		UniformPresence:      *flags.uniformPresence,
+		AbslHash:             *flags.abslHash,
+		LenientGetters:       *flags.lenientGetters,
+		UnionConversions:     unionConversions,
+		FitResultGetters:     *flags.fitResultGetters,
+		Lifetimebound:        *flags.lifetimebound,
+		StoragePolicy:        *flags.storagePolicy,
+		HandleBudget:         *flags.maxHandles,
+		ArenaBackedUnions:    *flags.arenaBackedUnions,
+		LazyUnions:           *flags.lazyUnions,
+		LayoutComments:       *flags.layoutComments,
+		AssertMacro:          *flags.assertMacro,
+		TraceHandles:         *flags.traceHandles,
+		UnknownMemberPolicy:  *flags.unknownMemberPolicy,
+		FlatProjections:      *flags.flatProjections,
+		Hardened:             *flags.hardened,
+		SimdAlignment:        *flags.simdAlign,
+		SetOnce:              *flags.setOnce,
+		TestHelpers:          *flags.testHelpers,
+		AllocationReport:     *flags.allocationReport,
+		StructuralComparison: *flags.structuralComparison,
+		DeepCopy:             *flags.deepCopy,
+		TypeErasedSet:        *flags.typeErasedSet,
+		UnionIntrospection:   *flags.unionIntrospection,
+		UnionEncode:          *flags.unionEncode,
+		StructuredBindings:   *flags.structuredBindings,
+		Coalesce:             *flags.coalesce,
+		WireFormat:           *flags.wireFormat,
+	})
 	if err := generator.GenerateHeader(tree, flags.Header(), *flags.ClangFormatPath); err != nil {
 		log.Fatalf("Error running header generator: %s", err)
 	}
@@ -91,4 +357,19 @@ func main() {
 	if err := generator.GenerateTestBase(tree, *flags.testBase, *flags.ClangFormatPath); err != nil {
 		log.Fatalf("Error running test base generator: %s", err)
 	}
+	if *flags.docOut != "" {
+		if err := generator.GenerateUnionDocs(tree, *flags.docOut); err != nil {
+			log.Fatalf("Error running union docs generator: %s", err)
+		}
+	}
+	if *flags.moduleInterface != "" {
+		if err := generator.GenerateModuleInterface(tree, *flags.moduleInterface, *flags.ClangFormatPath); err != nil {
+			log.Fatalf("Error running module interface generator: %s", err)
+		}
+	}
+	if *flags.emitCompatTest != "" {
+		if err := generator.GenerateCompatTest(tree, *flags.emitCompatTest, *flags.ClangFormatPath); err != nil {
+			log.Fatalf("Error running compat test generator: %s", err)
+		}
+	}
 }
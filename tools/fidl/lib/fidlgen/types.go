@@ -653,6 +653,29 @@ type UnionMember struct {
 	MaxOutOfLine int        `json:"max_out_of_line"`
 }
 
+// byUnionOrdinal is a wrapper type for sorting a []UnionMember.
+type byUnionOrdinal []UnionMember
+
+func (s byUnionOrdinal) Len() int {
+	return len(s)
+}
+
+func (s byUnionOrdinal) Less(i, j int) bool {
+	return s[i].Ordinal < s[j].Ordinal
+}
+
+func (s byUnionOrdinal) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// SortedMembers returns the union's members sorted by ordinal, including
+// reserved members.
+func (u *Union) SortedMembers() []UnionMember {
+	members := append([]UnionMember(nil), u.Members...)
+	sort.Stable(byUnionOrdinal(members))
+	return members
+}
+
 // Table represents a declaration of a FIDL table.
 type Table struct {
 	Decl
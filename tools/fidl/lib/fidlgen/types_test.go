@@ -258,3 +258,23 @@ func compoundIdentifier(library []string, name, member string) fidlgen.CompoundI
 		Member:  fidlgen.Identifier(member),
 	}
 }
+
+func TestUnionSortedMembers(t *testing.T) {
+	u := fidlgen.Union{
+		Members: []fidlgen.UnionMember{
+			{Ordinal: 3, Name: "c"},
+			{Ordinal: 1, Name: "a"},
+			{Ordinal: 2, Reserved: true},
+		},
+	}
+	var got []int
+	for _, m := range u.SortedMembers() {
+		got = append(got, m.Ordinal)
+	}
+	if diff := cmp.Diff([]int{1, 2, 3}, got); diff != "" {
+		t.Errorf("unexpected member order (-want +got):\n%s", diff)
+	}
+	if u.Members[0].Ordinal != 3 {
+		t.Errorf("SortedMembers reordered the union in place")
+	}
+}
@@ -130,6 +130,8 @@ type Type struct {
 	ElementType *Type
 	// Valid iff IsArray
 	ElementCount int
+	// Set iff IsVector and the vector is bounded
+	MaxElements int
 }
 
 // IsPrimitiveType returns true if this type is primitive.
@@ -137,6 +139,38 @@ func (t *Type) IsPrimitiveType() bool {
 	return t.Kind == TypeKinds.Primitive || t.Kind == TypeKinds.Bits || t.Kind == TypeKinds.Enum
 }
 
+// WireHostStub returns the wire type name used for this type in host stubs of
+// resource declarations, where handles are replaced by inert zx_handle_t
+// values. It returns "" if the type has no host stub, which is the case for
+// resource structs and tables.
+func (t *Type) WireHostStub() string {
+	if n, ok := t.wireHostStub(); ok {
+		return n.String()
+	}
+	return ""
+}
+
+func (t *Type) wireHostStub() (name, bool) {
+	switch t.Kind {
+	case TypeKinds.Handle, TypeKinds.Request, TypeKinds.Protocol:
+		return makeName("zx_handle_t"), true
+	case TypeKinds.Array:
+		if e, ok := t.ElementType.wireHostStub(); ok {
+			return makeName("fidl::Array").arrayTemplate(e, t.ElementCount), true
+		}
+		return name{}, false
+	case TypeKinds.Vector:
+		if e, ok := t.ElementType.wireHostStub(); ok {
+			return makeName("fidl::VectorView").template(e), true
+		}
+		return name{}, false
+	case TypeKinds.Struct, TypeKinds.Table:
+		return t.Wire, !t.IsResource
+	default:
+		return t.Wire, true
+	}
+}
+
 // WireArgumentDeclaration returns the argument declaration for this type for the wire variant.
 func (t *Type) WireArgumentDeclaration(n string) string {
 	switch t.WireFamily {
@@ -392,6 +426,9 @@ func (c *compiler) compileType(val fidlgen.Type) Type {
 		r.Kind = TypeKinds.Vector
 		r.IsResource = t.IsResource
 		r.ElementType = &t
+		if val.ElementCount != nil {
+			r.MaxElements = *val.ElementCount
+		}
 	case fidlgen.StringType:
 		if val.Nullable {
 			r.Natural = makeName("fidl::StringPtr")
@@ -544,6 +581,15 @@ func compile(r fidlgen.Root, h HeaderOptions) Root {
 		decls[v.Name] = c.compileUnion(v)
 	}
 
+	// Natural variants hold nested unions by value, so the unions are resolved
+	// in declaration order, which puts dependencies first.
+	naturalVariants := make(map[fidlgen.EncodedCompoundIdentifier]name)
+	for _, v := range r.DeclOrder {
+		if u, ok := decls[v].(Union); ok {
+			decls[v] = resolveNaturalVariant(u, naturalVariants)
+		}
+	}
+
 	for _, v := range r.Structs {
 		// TODO(fxbug.dev/7704) remove once anonymous structs are supported
 		if v.Anonymous {
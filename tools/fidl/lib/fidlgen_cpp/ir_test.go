@@ -39,3 +39,20 @@ protocol P {
 	// corresponding endpoint types can easily convert into each other.
 	expectEqual(t, ty.Unified.String(), "::std::vector<::fidl::InterfaceHandle<::foo::bar::P>>")
 }
+
+func TestWireHostStub(t *testing.T) {
+	handle := Type{Kind: TypeKinds.Handle, IsResource: true}
+	u32 := Type{nameVariants: primitiveNameVariants("uint32_t"), Kind: TypeKinds.Primitive}
+	resourceStruct := Type{nameVariants: commonNameVariants(makeName("foo::S")), Kind: TypeKinds.Struct, IsResource: true}
+	valueStruct := Type{nameVariants: commonNameVariants(makeName("foo::V")), Kind: TypeKinds.Struct}
+
+	expectEqual(t, handle.WireHostStub(), "zx_handle_t")
+	expectEqual(t, u32.WireHostStub(), "uint32_t")
+	expectEqual(t, valueStruct.WireHostStub(), "::foo::V")
+	expectEqual(t, resourceStruct.WireHostStub(), "")
+	expectEqual(t, (&Type{Kind: TypeKinds.Vector, ElementType: &handle}).WireHostStub(),
+		"::fidl::VectorView<zx_handle_t>")
+	expectEqual(t, (&Type{Kind: TypeKinds.Array, ElementType: &handle, ElementCount: 2}).WireHostStub(),
+		"::fidl::Array<zx_handle_t, 2>")
+	expectEqual(t, (&Type{Kind: TypeKinds.Vector, ElementType: &resourceStruct}).WireHostStub(), "")
+}
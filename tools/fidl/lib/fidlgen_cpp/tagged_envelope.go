@@ -0,0 +1,126 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen_cpp
+
+import (
+	"fmt"
+	"strings"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+// TaggedEnvelope describes a flexible union to synthesize on top of a library,
+// with one member per wrapped top-level declaration.
+type TaggedEnvelope struct {
+	// Name is the unqualified name of the synthesized union.
+	Name fidlgen.Identifier
+
+	// Members are the unqualified names of the wrapped declarations, in
+	// ordinal order.
+	Members []fidlgen.Identifier
+}
+
+// ParseTaggedEnvelope parses a tagged envelope specification of the form
+// "Name=Decl1,Decl2,...".
+func ParseTaggedEnvelope(spec string) (TaggedEnvelope, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return TaggedEnvelope{}, fmt.Errorf("invalid tagged envelope %q, expected Name=Decl1,Decl2,...", spec)
+	}
+	e := TaggedEnvelope{Name: fidlgen.Identifier(parts[0])}
+	for _, m := range strings.Split(parts[1], ",") {
+		e.Members = append(e.Members, fidlgen.Identifier(m))
+	}
+	return e, nil
+}
+
+// taggedEnvelopeAttribute marks a synthesized tagged envelope, so that the
+// generated union does not refer to a coding table fidlc never emitted.
+const taggedEnvelopeAttribute fidlgen.Identifier = "fidlgen_tagged_envelope"
+
+// AddTaggedEnvelope returns a copy of the library IR with the tagged envelope
+// added as a flexible union declaration. The union has no coding table of its
+// own, so it is meant for in-process dispatch rather than for encoding.
+func AddTaggedEnvelope(r fidlgen.Root, e TaggedEnvelope) (fidlgen.Root, error) {
+	library := fidlgen.ParseLibraryName(r.Name)
+	name := fidlgen.CompoundIdentifier{Library: library, Name: e.Name}.Encode()
+	if _, ok := r.Decls[name]; ok {
+		return r, fmt.Errorf("tagged envelope %s conflicts with an existing declaration", name)
+	}
+
+	shapes := make(map[fidlgen.EncodedCompoundIdentifier]fidlgen.TypeShape)
+	resourceness := make(map[fidlgen.EncodedCompoundIdentifier]fidlgen.Resourceness)
+	for _, v := range r.Structs {
+		shapes[v.Name] = v.TypeShapeV1
+		resourceness[v.Name] = v.Resourceness
+	}
+	for _, v := range r.Tables {
+		shapes[v.Name] = v.TypeShapeV1
+		resourceness[v.Name] = v.Resourceness
+	}
+	for _, v := range r.Unions {
+		shapes[v.Name] = v.TypeShapeV1
+		resourceness[v.Name] = v.Resourceness
+	}
+
+	u := fidlgen.Union{
+		Decl: fidlgen.Decl{
+			Attributes: fidlgen.Attributes{Attributes: []fidlgen.Attribute{
+				{
+					Name:  "Doc",
+					Value: " Tagged envelope synthesized by fidlgen; it is not part of the library schema.",
+				},
+				{Name: taggedEnvelopeAttribute},
+			}},
+			Name: name,
+		},
+		Strictness:   fidlgen.IsFlexible,
+		Resourceness: fidlgen.IsValueType,
+		// The inline part of every union is a fidl_xunion_t, i.e. an 8 byte
+		// ordinal followed by a 16 byte envelope, whatever its members are.
+		TypeShapeV1: fidlgen.TypeShape{
+			InlineSize:          24,
+			Alignment:           8,
+			HasPadding:          true,
+			HasFlexibleEnvelope: true,
+		},
+	}
+	for i, m := range e.Members {
+		memberName := fidlgen.CompoundIdentifier{Library: library, Name: m}.Encode()
+		shape, ok := shapes[memberName]
+		if !ok {
+			return r, fmt.Errorf("tagged envelope member %s is not a struct, table or union in %s", m, r.Name)
+		}
+		if resourceness[memberName].IsResourceType() {
+			u.Resourceness = fidlgen.IsResourceType
+		}
+		outOfLine := fidlAlign(shape.InlineSize) + shape.MaxOutOfLine
+		if outOfLine > u.TypeShapeV1.MaxOutOfLine {
+			u.TypeShapeV1.MaxOutOfLine = outOfLine
+		}
+		if shape.Depth+1 > u.TypeShapeV1.Depth {
+			u.TypeShapeV1.Depth = shape.Depth + 1
+		}
+		if shape.MaxHandles > u.TypeShapeV1.MaxHandles {
+			u.TypeShapeV1.MaxHandles = shape.MaxHandles
+		}
+		u.Members = append(u.Members, fidlgen.UnionMember{
+			Ordinal:      i + 1,
+			Type:         fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: memberName},
+			Name:         fidlgen.Identifier(fidlgen.ToSnakeCase(string(m))),
+			MaxOutOfLine: outOfLine,
+		})
+	}
+
+	r.Unions = append(append([]fidlgen.Union(nil), r.Unions...), u)
+	r.DeclOrder = append(append([]fidlgen.EncodedCompoundIdentifier(nil), r.DeclOrder...), name)
+	decls := make(fidlgen.DeclMap, len(r.Decls)+1)
+	for k, v := range r.Decls {
+		decls[k] = v
+	}
+	decls[name] = fidlgen.UnionDeclType
+	r.Decls = decls
+	return r, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen_cpp
+
+import (
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+func TestParseTaggedEnvelope(t *testing.T) {
+	e, err := ParseTaggedEnvelope("AnyMessage=FooRequest,BarTable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, e.Name, fidlgen.Identifier("AnyMessage"))
+	expectEqual(t, e.Members, []fidlgen.Identifier{"FooRequest", "BarTable"})
+
+	for _, spec := range []string{"", "AnyMessage", "AnyMessage=", "=Foo"} {
+		if _, err := ParseTaggedEnvelope(spec); err == nil {
+			t.Errorf("ParseTaggedEnvelope(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestAddTaggedEnvelope(t *testing.T) {
+	r := fidlgen.Root{
+		Name: "foo",
+		Structs: []fidlgen.Struct{{
+			Decl:        fidlgen.Decl{Name: "foo/S"},
+			TypeShapeV1: fidlgen.TypeShape{InlineSize: 4, MaxOutOfLine: 0},
+		}},
+		Tables: []fidlgen.Table{{
+			Decl:         fidlgen.Decl{Name: "foo/T"},
+			Resourceness: fidlgen.IsResourceType,
+			TypeShapeV1:  fidlgen.TypeShape{InlineSize: 16, Depth: 2, MaxHandles: 3, MaxOutOfLine: 40},
+		}},
+		DeclOrder: []fidlgen.EncodedCompoundIdentifier{"foo/S", "foo/T"},
+		Decls: fidlgen.DeclMap{
+			"foo/S": fidlgen.StructDeclType,
+			"foo/T": fidlgen.TableDeclType,
+		},
+	}
+
+	withEnvelope, err := AddTaggedEnvelope(r, TaggedEnvelope{Name: "Any", Members: []fidlgen.Identifier{"S", "T"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(r.Unions), 0)
+	assertEqual(t, len(withEnvelope.Unions), 1)
+	u := withEnvelope.Unions[0]
+	expectEqual(t, u.Name, fidlgen.EncodedCompoundIdentifier("foo/Any"))
+	expectEqual(t, u.IsFlexible(), true)
+	expectEqual(t, u.IsResourceType(), true)
+	expectEqual(t, u.TypeShapeV1.MaxHandles, 3)
+	expectEqual(t, u.TypeShapeV1.MaxOutOfLine, 56)
+	expectEqual(t, u.TypeShapeV1.Depth, 3)
+	expectEqual(t, u.HasAttribute(taggedEnvelopeAttribute), true)
+	assertEqual(t, len(u.Members), 2)
+	expectEqual(t, u.Members[0].Name, fidlgen.Identifier("s"))
+	expectEqual(t, u.Members[0].Ordinal, 1)
+	expectEqual(t, u.Members[1].Name, fidlgen.Identifier("t"))
+	expectEqual(t, u.Members[1].Ordinal, 2)
+	expectEqual(t, withEnvelope.Decls["foo/Any"], fidlgen.UnionDeclType)
+	expectEqual(t, withEnvelope.DeclOrder[len(withEnvelope.DeclOrder)-1], fidlgen.EncodedCompoundIdentifier("foo/Any"))
+
+	if _, err := AddTaggedEnvelope(r, TaggedEnvelope{Name: "S", Members: []fidlgen.Identifier{"T"}}); err == nil {
+		t.Error("expected a conflict with an existing declaration")
+	}
+	if _, err := AddTaggedEnvelope(r, TaggedEnvelope{Name: "Any", Members: []fidlgen.Identifier{"Missing"}}); err == nil {
+		t.Error("expected an error for an unknown member")
+	}
+}
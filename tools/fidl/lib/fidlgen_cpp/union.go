@@ -5,6 +5,12 @@
 package fidlgen_cpp
 
 import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"regexp"
+	"strings"
+
 	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
 )
 
@@ -22,12 +28,70 @@ type Union struct {
 	WireInvalidOrdinal name
 	Members            []UnionMember
 	Result             *Result
+	BackingBufferType  string
+
+	// HasCodingTable is false for unions synthesized by fidlgen, for which
+	// fidlc emits no coding table. See AddTaggedEnvelope.
+	HasCodingTable bool
+
+	// TypeName is the fully qualified FIDL name of the union, e.g.
+	// "fuchsia.library/MyUnion".
+	TypeName string
+
+	// NaturalVariant is the name of the std::variant backed counterpart of the
+	// wire union, e.g. "fuchsia_library::natural::MyUnion".
+	NaturalVariant name
+
+	// HasNaturalVariant is whether every member can be held by value in the
+	// natural variant. See naturalVariantType.
+	HasNaturalVariant bool
+
+	// PrimaryMember is the member annotated with @cpp_primary_member, which
+	// is also exposed through value() and mutable_value(), if any.
+	PrimaryMember *UnionMember
+
+	// WireAbiHash fingerprints the wire format of the union, so that peers
+	// can check that they agree on it. See wireAbiHash.
+	WireAbiHash uint64
 }
 
 func (Union) Kind() declKind {
 	return Kinds.Union
 }
 
+// HasCapabilityMembers returns whether any member of the union requires a
+// CapabilityToken to be accessed.
+func (u Union) HasCapabilityMembers() bool {
+	for _, m := range u.Members {
+		if m.RequiresCap {
+			return true
+		}
+	}
+	return false
+}
+
+// HasHiddenMembers returns whether any member of the union is hidden from the
+// accessors which take any member. See UnionMember.IsHidden.
+func (u Union) HasHiddenMembers() bool {
+	for _, m := range u.Members {
+		if m.IsHidden() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasExperimentalMembers returns whether any member of the union is
+// experimental.
+func (u Union) HasExperimentalMembers() bool {
+	for _, m := range u.Members {
+		if m.IsExperimental {
+			return true
+		}
+	}
+	return false
+}
+
 var _ Kinded = (*Union)(nil)
 var _ namespaced = (*Union)(nil)
 
@@ -41,6 +105,38 @@ type UnionMember struct {
 	WireOrdinalName   name
 	Offset            int
 	HandleInformation *HandleInformation
+
+	// MaxOutOfLine is the most out-of-line bytes the member may have.
+	MaxOutOfLine int
+
+	// IsExperimental is set for members annotated with @experimental, whose
+	// accessors consumers must opt into.
+	IsExperimental bool
+
+	// RequiresCap is set for members annotated with @requires_cap, whose
+	// getters take the union's CapabilityToken.
+	RequiresCap bool
+
+	// Validator is the function named by @cpp_validate, if any, which set_x()
+	// calls to reject invalid values.
+	Validator string
+
+	// FidlTypeName is the type of the member as written in FIDL, e.g.
+	// "vector<uint8>:16".
+	FidlTypeName string
+
+	// NaturalType is the type holding the member in the natural variant of
+	// the union, e.g. "std::vector<std::string>", if the union has one.
+	NaturalType string
+}
+
+// IsHidden returns whether the member is left out of the accessors which take
+// any member, such as visit(), because its own accessors are restricted: it
+// requires a CapabilityToken, or is experimental. Leaving it out regardless of
+// FIDL_ALLOW_EXPERIMENTAL keeps inline functions the same in every translation
+// unit.
+func (um UnionMember) IsHidden() bool {
+	return um.RequiresCap || um.IsExperimental
 }
 
 func (um UnionMember) UpperCamelCaseName() string {
@@ -51,13 +147,18 @@ func (um UnionMember) NameAndType() (string, Type) {
 	return um.Name(), um.Type
 }
 func (c *compiler) compileUnion(val fidlgen.Union) Union {
+	// TODO: Emit unions declared inside another layout as nested classes of
+	// the enclosing type (e.g. wire::Outer::Inner). The JSON IR only records
+	// the flattened declaration name, not its enclosing scope, so fidlc must
+	// expose the naming context before the generator can reconstruct it.
 	name := c.compileNameVariants(val.Name)
 	codingTableType := c.compileCodingTableType(val.Name)
 	tagEnum := name.nest("Tag")
 	wireOrdinalEnum := name.Wire.nest("Ordinal")
+	ts := TypeShape{val.TypeShapeV1}
 	u := Union{
 		Attributes:         Attributes{val.Attributes},
-		TypeShape:          TypeShape{val.TypeShapeV1},
+		TypeShape:          ts,
 		Strictness:         val.Strictness,
 		Resourceness:       val.Resourceness,
 		nameVariants:       name,
@@ -67,12 +168,31 @@ func (c *compiler) compileUnion(val fidlgen.Union) Union {
 		TagInvalid:         tagEnum.nest("Invalid"),
 		WireOrdinalEnum:    wireOrdinalEnum,
 		WireInvalidOrdinal: wireOrdinalEnum.nest("Invalid"),
+		BackingBufferType: computeAllocation(
+			ts.MaxTotalSize(), boundednessBounded).
+			BackingBufferType(),
+		HasCodingTable: !val.HasAttribute(taggedEnvelopeAttribute),
+		TypeName:       string(val.Name),
+		NaturalVariant: name.Unified.appendNamespace("natural"),
+		WireAbiHash:    wireAbiHash(val),
 	}
 
+	primary, err := unionPrimaryMember(val)
+	if err != nil {
+		panic(err)
+	}
+	primaryIndex := -1
 	for _, mem := range val.Members {
 		if mem.Reserved {
 			continue
 		}
+		if mem.Name == primary {
+			primaryIndex = len(u.Members)
+		}
+		validator, err := unionMemberValidator(val, mem)
+		if err != nil {
+			panic(err)
+		}
 		name := unionMemberContext.transform(mem.Name)
 		tag := unionMemberTagContext.transform(mem.Name)
 		u.Members = append(u.Members, UnionMember{
@@ -85,8 +205,19 @@ func (c *compiler) compileUnion(val fidlgen.Union) Union {
 			WireOrdinalName:   u.WireOrdinalEnum.nest(tag.Wire.Name()),
 			Offset:            mem.Offset,
 			HandleInformation: c.fieldHandleInformation(&mem.Type),
+			MaxOutOfLine:      mem.MaxOutOfLine,
+			IsExperimental:    mem.HasAttribute("experimental"),
+			RequiresCap:       mem.HasAttribute("requires_cap"),
+			Validator:         validator,
+			FidlTypeName:      fidlTypeName(mem.Type),
 		})
 	}
+	if err := checkCapabilityMembers(val, primary); err != nil {
+		panic(err)
+	}
+	if primaryIndex >= 0 {
+		u.PrimaryMember = &u.Members[primaryIndex]
+	}
 
 	if val.MethodResult != nil {
 		result := Result{
@@ -101,3 +232,236 @@ func (c *compiler) compileUnion(val fidlgen.Union) Union {
 
 	return u
 }
+
+// naturalVariantType returns the type holding a value of type |t| in a natural
+// variant union, which owns all of its data: strings and vectors become
+// std::string and std::vector, wrapped in cpp17::optional if nullable, and
+// nested unions their natural variant, as given by |variants|. It returns false
+// if there is none, as for structs and tables, which have no natural
+// counterpart in these bindings.
+func naturalVariantType(t Type, variants map[fidlgen.EncodedCompoundIdentifier]name) (string, bool) {
+	optional := func(s string) string {
+		if t.Nullable {
+			return fmt.Sprintf("cpp17::optional<%s>", s)
+		}
+		return s
+	}
+	switch t.Kind {
+	case TypeKinds.Struct, TypeKinds.Table:
+		return "", false
+	case TypeKinds.Union:
+		n, ok := variants[t.DeclarationName]
+		if !ok {
+			return "", false
+		}
+		return n.String(), true
+	case TypeKinds.String:
+		return optional("std::string"), true
+	case TypeKinds.Vector:
+		e, ok := naturalVariantType(*t.ElementType, variants)
+		return optional(fmt.Sprintf("std::vector<%s>", e)), ok
+	case TypeKinds.Array:
+		e, ok := naturalVariantType(*t.ElementType, variants)
+		return fmt.Sprintf("std::array<%s, %d>", e, t.ElementCount), ok
+	default:
+		return t.Wire.String(), true
+	}
+}
+
+// resolveNaturalVariant sets the NaturalType of the members of |u|, and
+// HasNaturalVariant, if all of them can be held in its natural variant. The
+// variant is then added to |variants|, so that the unions declared after |u|
+// can nest it, unless converting it requires a CapabilityToken.
+func resolveNaturalVariant(u Union, variants map[fidlgen.EncodedCompoundIdentifier]name) Union {
+	types := make([]string, len(u.Members))
+	for i, m := range u.Members {
+		t, ok := naturalVariantType(m.Type, variants)
+		if !ok {
+			return u
+		}
+		types[i] = t
+	}
+	for i := range u.Members {
+		u.Members[i].NaturalType = types[i]
+	}
+	u.HasNaturalVariant = true
+	if !u.HasCapabilityMembers() {
+		variants[fidlgen.EncodedCompoundIdentifier(u.TypeName)] = u.NaturalVariant
+	}
+	return u
+}
+
+// checkCapabilityMembers returns an error if a member of |val| is annotated
+// with @requires_cap but its accessors cannot be restricted to token holders:
+// value unions have friends, such as conversions, that read every member, and
+// value() would expose the primary member.
+func checkCapabilityMembers(val fidlgen.Union, primary fidlgen.Identifier) error {
+	for _, mem := range val.Members {
+		if mem.Reserved || !mem.HasAttribute("requires_cap") {
+			continue
+		}
+		if val.IsValueType() {
+			return fmt.Errorf("union %s is not a resource, but its member %s has @requires_cap",
+				val.Name, mem.Name)
+		}
+		if mem.Name == primary {
+			return fmt.Errorf("union %s has @requires_cap on its @cpp_primary_member %s",
+				val.Name, mem.Name)
+		}
+	}
+	return nil
+}
+
+var validatorPattern = regexp.MustCompile(`^(::)?[A-Za-z_][A-Za-z0-9_]*(::[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// unionMemberValidator returns the name of the C++ function given by the
+// @cpp_validate attribute of |mem|, a member of |val|, or "" if there is none.
+// The function takes a const reference to the member and returns whether it
+// is valid.
+func unionMemberValidator(val fidlgen.Union, mem fidlgen.UnionMember) (string, error) {
+	attr, ok := mem.LookupAttribute("cpp_validate")
+	if !ok {
+		return "", nil
+	}
+	if !validatorPattern.MatchString(attr.Value) {
+		return "", fmt.Errorf("union %s has @cpp_validate(%q) on its member %s, which is not a C++ function name",
+			val.Name, attr.Value, mem.Name)
+	}
+	return attr.Value, nil
+}
+
+// unionPrimaryMember returns the name of the member of |val| annotated with
+// @cpp_primary_member, or "" if there is none.
+func unionPrimaryMember(val fidlgen.Union) (fidlgen.Identifier, error) {
+	var primary fidlgen.Identifier
+	for _, mem := range val.Members {
+		if mem.Reserved || !mem.HasAttribute("cpp_primary_member") {
+			continue
+		}
+		if primary != "" {
+			return "", fmt.Errorf("union %s has more than one @cpp_primary_member: %s and %s",
+				val.Name, primary, mem.Name)
+		}
+		primary = mem.Name
+	}
+	if primary == "" {
+		return "", nil
+	}
+	for _, mem := range val.Members {
+		if !mem.Reserved && mem.Name == "value" {
+			return "", fmt.Errorf("union %s has @cpp_primary_member but also a member named value", val.Name)
+		}
+	}
+	return primary, nil
+}
+
+// wireAbiHash returns the 64-bit FNV-1a hash of the parts of |val| that
+// determine its wire format: strictness, resourceness, type shape, and the
+// ordinal and type of each member. Member names and declaration order, which
+// do not affect the wire format, are left out. Types are identified by name,
+// so renaming a member type also changes the hash.
+func wireAbiHash(val fidlgen.Union) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%t %t %+v", val.Strictness, val.Resourceness, val.TypeShapeV1)
+	for _, mem := range val.SortedMembers() {
+		if mem.Reserved {
+			continue
+		}
+		fmt.Fprintf(h, ";%d:", mem.Ordinal)
+		writeWireAbiType(h, mem.Type)
+	}
+	return h.Sum64()
+}
+
+func writeWireAbiType(w io.Writer, t fidlgen.Type) {
+	fmt.Fprintf(w, "(%s %s %s %d %s %s %t %d", t.Kind, t.PrimitiveSubtype, t.HandleSubtype, t.HandleRights,
+		t.RequestSubtype, t.Identifier, t.Nullable, t.ObjType)
+	if t.ElementCount != nil {
+		fmt.Fprintf(w, " %d", *t.ElementCount)
+	}
+	if t.ElementType != nil {
+		fmt.Fprint(w, " ")
+		writeWireAbiType(w, *t.ElementType)
+	}
+	fmt.Fprint(w, ")")
+}
+
+// fidlTypeName returns |t| as written in FIDL, e.g. "vector<uint8>:16" or
+// "string:optional".
+func fidlTypeName(t fidlgen.Type) string {
+	var name string
+	switch t.Kind {
+	case fidlgen.ArrayType:
+		return fmt.Sprintf("array<%s, %d>", fidlTypeName(*t.ElementType), *t.ElementCount)
+	case fidlgen.VectorType:
+		name = fmt.Sprintf("vector<%s>", fidlTypeName(*t.ElementType))
+	case fidlgen.StringType:
+		name = "string"
+	case fidlgen.HandleType:
+		name = "zx/handle"
+		if t.HandleSubtype != fidlgen.Handle {
+			name += ":" + strings.ToUpper(string(t.HandleSubtype))
+		}
+	case fidlgen.RequestType:
+		name = fmt.Sprintf("server_end:%s", t.RequestSubtype)
+	case fidlgen.PrimitiveType:
+		return string(t.PrimitiveSubtype)
+	case fidlgen.IdentifierType:
+		name = string(t.Identifier)
+	default:
+		panic(fmt.Sprintf("unknown type kind: %v", t.Kind))
+	}
+	if t.ElementCount != nil {
+		name += fmt.Sprintf(":%d", *t.ElementCount)
+	}
+	if t.Nullable {
+		name += ":optional"
+	}
+	return name
+}
+
+// SortUnionMembersByOrdinal returns a copy of the library IR in which the
+// members of every union are in ordinal order rather than declaration order,
+// so that the generated code does not change when members are reordered.
+func SortUnionMembersByOrdinal(r fidlgen.Root) fidlgen.Root {
+	unions := make([]fidlgen.Union, 0, len(r.Unions))
+	for _, u := range r.Unions {
+		u.Members = u.SortedMembers()
+		unions = append(unions, u)
+	}
+	r.Unions = unions
+	return r
+}
+
+// SingleMemberUnions returns the unions of the library IR which have exactly
+// one non-reserved member. Such unions are usually a schema mistake or a
+// placeholder.
+func SingleMemberUnions(r fidlgen.Root) []fidlgen.EncodedCompoundIdentifier {
+	var names []fidlgen.EncodedCompoundIdentifier
+	for _, u := range r.Unions {
+		active := 0
+		for _, m := range u.Members {
+			if !m.Reserved {
+				active++
+			}
+		}
+		if active == 1 {
+			names = append(names, u.Name)
+		}
+	}
+	return names
+}
+
+// CheckUniformPresence returns an error if a union of the library IR has a
+// member whose ordinal does not fit in the 64 bit presence mask returned by
+// PresenceMask().
+func CheckUniformPresence(r fidlgen.Root) error {
+	for _, u := range r.Unions {
+		for _, m := range u.Members {
+			if !m.Reserved && m.Ordinal > 64 {
+				return fmt.Errorf("union %s has member %s with ordinal %d, which does not fit in a presence mask", u.Name, m.Name, m.Ordinal)
+			}
+		}
+	}
+	return nil
+}
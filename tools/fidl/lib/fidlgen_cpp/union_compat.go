@@ -0,0 +1,48 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen_cpp
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+// CheckUnionCompat returns an error if a union of |old| that is still in
+// |new| is no longer wire compatible with it: each member of the old union
+// must keep its ordinal in the new one, either with the same type or as a
+// reserved member. Unions only in one of the libraries are not checked.
+func CheckUnionCompat(old fidlgen.Root, new fidlgen.Root) error {
+	newUnions := make(map[fidlgen.EncodedCompoundIdentifier]fidlgen.Union)
+	for _, u := range new.Unions {
+		newUnions[u.Name] = u
+	}
+	for _, oldUnion := range old.Unions {
+		newUnion, ok := newUnions[oldUnion.Name]
+		if !ok {
+			continue
+		}
+		newMembers := make(map[int]fidlgen.UnionMember)
+		for _, mem := range newUnion.Members {
+			newMembers[mem.Ordinal] = mem
+		}
+		for _, oldMem := range oldUnion.Members {
+			if oldMem.Reserved {
+				continue
+			}
+			newMem, ok := newMembers[oldMem.Ordinal]
+			if !ok {
+				return fmt.Errorf("union %s no longer has ordinal %d, of member %s",
+					oldUnion.Name, oldMem.Ordinal, oldMem.Name)
+			}
+			if !newMem.Reserved && !reflect.DeepEqual(oldMem.Type, newMem.Type) {
+				return fmt.Errorf("union %s changed the type of member %s, with ordinal %d",
+					oldUnion.Name, oldMem.Name, oldMem.Ordinal)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen_cpp
+
+import (
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+func TestCheckUnionCompat(t *testing.T) {
+	uint32Type := fidlgen.Type{Kind: fidlgen.PrimitiveType, PrimitiveSubtype: fidlgen.Uint32}
+	uint64Type := fidlgen.Type{Kind: fidlgen.PrimitiveType, PrimitiveSubtype: fidlgen.Uint64}
+	root := func(members ...fidlgen.UnionMember) fidlgen.Root {
+		return fidlgen.Root{
+			Name:   "foo",
+			Unions: []fidlgen.Union{{Decl: fidlgen.Decl{Name: "foo/U"}, Members: members}},
+		}
+	}
+	old := root(
+		fidlgen.UnionMember{Ordinal: 1, Name: "a", Type: uint32Type},
+		fidlgen.UnionMember{Ordinal: 2, Reserved: true},
+	)
+
+	compatible := map[string]fidlgen.Root{
+		"same":           old,
+		"renamed":        root(fidlgen.UnionMember{Ordinal: 1, Name: "b", Type: uint32Type}),
+		"reserved":       root(fidlgen.UnionMember{Ordinal: 1, Reserved: true}),
+		"added":          root(fidlgen.UnionMember{Ordinal: 1, Name: "a", Type: uint32Type}, fidlgen.UnionMember{Ordinal: 3, Name: "c", Type: uint64Type}),
+		"union removed":  {Name: "foo"},
+		"reserved taken": root(fidlgen.UnionMember{Ordinal: 1, Name: "a", Type: uint32Type}, fidlgen.UnionMember{Ordinal: 2, Name: "b", Type: uint64Type}),
+	}
+	for name, new := range compatible {
+		if err := CheckUnionCompat(old, new); err != nil {
+			t.Errorf("CheckUnionCompat(%s) = %v, want nil", name, err)
+		}
+	}
+
+	incompatible := map[string]fidlgen.Root{
+		"removed":      root(),
+		"renumbered":   root(fidlgen.UnionMember{Ordinal: 3, Name: "a", Type: uint32Type}),
+		"type changed": root(fidlgen.UnionMember{Ordinal: 1, Name: "a", Type: uint64Type}),
+	}
+	for name, new := range incompatible {
+		if err := CheckUnionCompat(old, new); err == nil {
+			t.Errorf("CheckUnionCompat(%s) succeeded, want error", name)
+		}
+	}
+}
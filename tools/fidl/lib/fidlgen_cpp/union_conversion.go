@@ -0,0 +1,93 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen_cpp
+
+import (
+	"fmt"
+	"strings"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+// UnionConversion describes a function to generate, converting a union of the
+// library to a structurally identical wire union, typically declared by
+// another library during a migration. Members are matched by name.
+type UnionConversion struct {
+	// Source is the unqualified name of the union converted from.
+	Source fidlgen.Identifier
+
+	// Target is the fully qualified C++ name of the wire union converted to,
+	// e.g. "::fuchsia_legacy::wire::OldUnion".
+	Target string
+}
+
+// FunctionName is the name of the generated conversion function, e.g.
+// "ConvertNewUnionToOldUnion".
+func (c UnionConversion) FunctionName() string {
+	target := c.Target[strings.LastIndex(c.Target, "::")+len("::"):]
+	return fmt.Sprintf("Convert%sTo%s", c.Source, target)
+}
+
+// ParseUnionConversions parses union conversion specifications of the form
+// "Source1=::target::wire::Target1,Source2=...".
+func ParseUnionConversions(spec string) ([]UnionConversion, error) {
+	var conversions []UnionConversion
+	for _, s := range strings.Split(spec, ",") {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !strings.HasPrefix(parts[1], "::") {
+			return nil, fmt.Errorf("invalid union conversion %q, expected Source=::target::wire::Target", s)
+		}
+		conversions = append(conversions, UnionConversion{
+			Source: fidlgen.Identifier(parts[0]),
+			Target: parts[1],
+		})
+	}
+	return conversions, nil
+}
+
+// CheckUnionConversions returns an error unless the source of each conversion
+// is a union of the library without handles, which cannot be copied, whose
+// members all have the same C++ type in the target; see isConvertible.
+func CheckUnionConversions(r fidlgen.Root, conversions []UnionConversion) error {
+	library := fidlgen.ParseLibraryName(r.Name)
+	for _, c := range conversions {
+		name := fidlgen.CompoundIdentifier{Library: library, Name: c.Source}.Encode()
+		found := false
+		for _, u := range r.Unions {
+			if u.Name != name {
+				continue
+			}
+			if u.IsResourceType() {
+				return fmt.Errorf("union conversion source %s is a resource type", name)
+			}
+			for _, m := range u.Members {
+				if !m.Reserved && !isConvertible(m.Type) {
+					return fmt.Errorf("union conversion source %s has member %s, which is not a primitive, string, array or vector",
+						name, m.Name)
+				}
+			}
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("union conversion source %s is not a union of the library", name)
+		}
+	}
+	return nil
+}
+
+// isConvertible returns whether a value of type |t| has the same C++ type in
+// any library, so that it can be copied to the member of a union declared by
+// another library. Declared types, such as structs or enums, are distinct in
+// each library that declares them.
+func isConvertible(t fidlgen.Type) bool {
+	switch t.Kind {
+	case fidlgen.PrimitiveType, fidlgen.StringType:
+		return true
+	case fidlgen.ArrayType, fidlgen.VectorType:
+		return isConvertible(*t.ElementType)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen_cpp
+
+import (
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+func TestParseUnionConversions(t *testing.T) {
+	cs, err := ParseUnionConversions("U=::legacy::wire::OldU,V=::legacy::wire::V")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, cs, []UnionConversion{
+		{Source: "U", Target: "::legacy::wire::OldU"},
+		{Source: "V", Target: "::legacy::wire::V"},
+	})
+	expectEqual(t, cs[0].FunctionName(), "ConvertUToOldU")
+
+	for _, spec := range []string{"", "U", "U=", "=::legacy::wire::U", "U=legacy::wire::U"} {
+		if _, err := ParseUnionConversions(spec); err == nil {
+			t.Errorf("ParseUnionConversions(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestCheckUnionConversions(t *testing.T) {
+	uint8Type := fidlgen.Type{Kind: fidlgen.PrimitiveType, PrimitiveSubtype: fidlgen.Uint8}
+	r := fidlgen.Root{
+		Name: "foo",
+		Unions: []fidlgen.Union{
+			{
+				Decl: fidlgen.Decl{Name: "foo/Value"},
+				Members: []fidlgen.UnionMember{
+					{Ordinal: 1, Name: "a", Type: uint8Type},
+					{Ordinal: 2, Name: "s", Type: fidlgen.Type{Kind: fidlgen.StringType}},
+					{Ordinal: 3, Name: "v", Type: fidlgen.Type{Kind: fidlgen.VectorType, ElementType: &uint8Type}},
+					{Ordinal: 4, Reserved: true},
+				},
+			},
+			{Decl: fidlgen.Decl{Name: "foo/Res"}, Resourceness: fidlgen.IsResourceType},
+			{
+				Decl: fidlgen.Decl{Name: "foo/Nested"},
+				Members: []fidlgen.UnionMember{
+					{Ordinal: 1, Name: "s", Type: fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "foo/S"}},
+				},
+			},
+		},
+	}
+
+	if err := CheckUnionConversions(r, []UnionConversion{{Source: "Value", Target: "::bar::wire::Value"}}); err != nil {
+		t.Errorf("CheckUnionConversions(Value) = %v, want nil", err)
+	}
+	for _, source := range []fidlgen.Identifier{"Res", "Nested", "Missing"} {
+		if err := CheckUnionConversions(r, []UnionConversion{{Source: source, Target: "::bar::wire::U"}}); err == nil {
+			t.Errorf("CheckUnionConversions(%s) succeeded, want error", source)
+		}
+	}
+}
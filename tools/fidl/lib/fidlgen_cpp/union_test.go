@@ -0,0 +1,229 @@
+// Copyright 2021 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fidlgen_cpp
+
+import (
+	"testing"
+
+	"go.fuchsia.dev/fuchsia/tools/fidl/lib/fidlgen"
+)
+
+func TestSingleMemberUnions(t *testing.T) {
+	r := fidlgen.Root{
+		Unions: []fidlgen.Union{
+			{
+				Decl:    fidlgen.Decl{Name: "foo/One"},
+				Members: []fidlgen.UnionMember{{Ordinal: 1, Name: "a"}},
+			},
+			{
+				Decl: fidlgen.Decl{Name: "foo/OneWithReserved"},
+				Members: []fidlgen.UnionMember{
+					{Ordinal: 1, Reserved: true},
+					{Ordinal: 2, Name: "b"},
+				},
+			},
+			{
+				Decl: fidlgen.Decl{Name: "foo/Two"},
+				Members: []fidlgen.UnionMember{
+					{Ordinal: 1, Name: "a"},
+					{Ordinal: 2, Name: "b"},
+				},
+			},
+		},
+	}
+	expectEqual(t, SingleMemberUnions(r), []fidlgen.EncodedCompoundIdentifier{"foo/One", "foo/OneWithReserved"})
+}
+
+func TestUnionPrimaryMember(t *testing.T) {
+	primary := fidlgen.Attributes{Attributes: []fidlgen.Attribute{{Name: "cpp_primary_member"}}}
+
+	none := fidlgen.Union{
+		Decl:    fidlgen.Decl{Name: "foo/None"},
+		Members: []fidlgen.UnionMember{{Ordinal: 1, Name: "a"}},
+	}
+	name, err := unionPrimaryMember(none)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, name, fidlgen.Identifier(""))
+
+	one := fidlgen.Union{
+		Decl: fidlgen.Decl{Name: "foo/One"},
+		Members: []fidlgen.UnionMember{
+			{Ordinal: 1, Name: "a"},
+			{Ordinal: 2, Name: "b", Attributes: primary},
+		},
+	}
+	name, err = unionPrimaryMember(one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, name, fidlgen.Identifier("b"))
+
+	for _, members := range [][]fidlgen.UnionMember{
+		{{Ordinal: 1, Name: "a", Attributes: primary}, {Ordinal: 2, Name: "b", Attributes: primary}},
+		{{Ordinal: 1, Name: "a", Attributes: primary}, {Ordinal: 2, Name: "value"}},
+	} {
+		u := fidlgen.Union{Decl: fidlgen.Decl{Name: "foo/Bad"}, Members: members}
+		if _, err := unionPrimaryMember(u); err == nil {
+			t.Errorf("unionPrimaryMember(%v) succeeded, want error", members)
+		}
+	}
+}
+
+func TestUnionMemberValidator(t *testing.T) {
+	u := fidlgen.Union{Decl: fidlgen.Decl{Name: "foo/U"}}
+	validate := func(fn string) fidlgen.UnionMember {
+		return fidlgen.UnionMember{
+			Ordinal:    1,
+			Name:       "a",
+			Attributes: fidlgen.Attributes{Attributes: []fidlgen.Attribute{{Name: "cpp_validate", Value: fn}}},
+		}
+	}
+
+	name, err := unionMemberValidator(u, fidlgen.UnionMember{Ordinal: 1, Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEqual(t, name, "")
+
+	for _, fn := range []string{"IsValidUrl", "::net::IsValidUrl", "net::url::IsValid"} {
+		name, err := unionMemberValidator(u, validate(fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEqual(t, name, fn)
+	}
+
+	for _, fn := range []string{"", "IsValid(x)", "net::", "1st"} {
+		if _, err := unionMemberValidator(u, validate(fn)); err == nil {
+			t.Errorf("unionMemberValidator(@cpp_validate(%q)) succeeded, want error", fn)
+		}
+	}
+}
+
+func TestFidlTypeName(t *testing.T) {
+	count := 16
+	uint8Type := fidlgen.Type{Kind: fidlgen.PrimitiveType, PrimitiveSubtype: fidlgen.Uint8}
+	cases := []struct {
+		typ      fidlgen.Type
+		expected string
+	}{
+		{uint8Type, "uint8"},
+		{fidlgen.Type{Kind: fidlgen.StringType}, "string"},
+		{fidlgen.Type{Kind: fidlgen.StringType, ElementCount: &count, Nullable: true}, "string:16:optional"},
+		{fidlgen.Type{Kind: fidlgen.VectorType, ElementType: &uint8Type, ElementCount: &count}, "vector<uint8>:16"},
+		{fidlgen.Type{Kind: fidlgen.ArrayType, ElementType: &uint8Type, ElementCount: &count}, "array<uint8, 16>"},
+		{fidlgen.Type{Kind: fidlgen.HandleType, HandleSubtype: fidlgen.Handle}, "zx/handle"},
+		{fidlgen.Type{Kind: fidlgen.HandleType, HandleSubtype: fidlgen.Vmo, Nullable: true}, "zx/handle:VMO:optional"},
+		{fidlgen.Type{Kind: fidlgen.RequestType, RequestSubtype: "foo/P"}, "server_end:foo/P"},
+		{fidlgen.Type{Kind: fidlgen.IdentifierType, Identifier: "foo/S", Nullable: true}, "foo/S:optional"},
+	}
+	for _, c := range cases {
+		expectEqual(t, fidlTypeName(c.typ), c.expected)
+	}
+}
+
+func TestNaturalVariantType(t *testing.T) {
+	uint32Type := Type{nameVariants: NameVariantsForPrimitive(fidlgen.Uint32), Kind: TypeKinds.Primitive}
+	stringType := Type{Kind: TypeKinds.String}
+	innerType := Type{Kind: TypeKinds.Union, DeclarationName: "foo/Inner"}
+	variants := map[fidlgen.EncodedCompoundIdentifier]name{
+		"foo/Inner": makeName("foo::natural::Inner"),
+	}
+	cases := []struct {
+		typ      Type
+		expected string
+	}{
+		{uint32Type, "uint32_t"},
+		{stringType, "std::string"},
+		{Type{Kind: TypeKinds.String, Nullable: true}, "cpp17::optional<std::string>"},
+		{Type{Kind: TypeKinds.Vector, ElementType: &stringType}, "std::vector<std::string>"},
+		{Type{Kind: TypeKinds.Array, ElementType: &uint32Type, ElementCount: 4}, "std::array<uint32_t, 4>"},
+		{innerType, "::foo::natural::Inner"},
+	}
+	for _, c := range cases {
+		typ, ok := naturalVariantType(c.typ, variants)
+		if !ok {
+			t.Errorf("naturalVariantType(%v) failed", c.typ)
+		}
+		expectEqual(t, typ, c.expected)
+	}
+
+	structType := Type{Kind: TypeKinds.Struct, DeclarationName: "foo/S"}
+	for _, typ := range []Type{
+		structType,
+		{Kind: TypeKinds.Vector, ElementType: &structType},
+		{Kind: TypeKinds.Union, DeclarationName: "foo/Other"},
+	} {
+		if _, ok := naturalVariantType(typ, variants); ok {
+			t.Errorf("naturalVariantType(%v) succeeded, want failure", typ)
+		}
+	}
+}
+
+func TestWireAbiHash(t *testing.T) {
+	uint32Type := fidlgen.Type{Kind: fidlgen.PrimitiveType, PrimitiveSubtype: fidlgen.Uint32}
+	stringType := fidlgen.Type{Kind: fidlgen.StringType}
+	u := fidlgen.Union{
+		Decl: fidlgen.Decl{Name: "foo/U"},
+		Members: []fidlgen.UnionMember{
+			{Ordinal: 1, Name: "a", Type: uint32Type},
+			{Ordinal: 2, Name: "b", Type: stringType},
+		},
+	}
+	hash := wireAbiHash(u)
+
+	renamedAndReordered := u
+	renamedAndReordered.Members = []fidlgen.UnionMember{
+		{Ordinal: 2, Name: "y", Type: stringType},
+		{Ordinal: 1, Name: "x", Type: uint32Type},
+	}
+	expectEqual(t, wireAbiHash(renamedAndReordered), hash)
+
+	renumbered := u
+	renumbered.Members = []fidlgen.UnionMember{
+		{Ordinal: 1, Name: "a", Type: uint32Type},
+		{Ordinal: 3, Name: "b", Type: stringType},
+	}
+	if wireAbiHash(renumbered) == hash {
+		t.Errorf("wireAbiHash ignores member ordinals")
+	}
+
+	retyped := u
+	retyped.Members = []fidlgen.UnionMember{
+		{Ordinal: 1, Name: "a", Type: stringType},
+		{Ordinal: 2, Name: "b", Type: stringType},
+	}
+	if wireAbiHash(retyped) == hash {
+		t.Errorf("wireAbiHash ignores member types")
+	}
+
+	strict := u
+	strict.Strictness = fidlgen.IsStrict
+	if wireAbiHash(strict) == hash {
+		t.Errorf("wireAbiHash ignores strictness")
+	}
+}
+
+func TestCheckUniformPresence(t *testing.T) {
+	r := fidlgen.Root{
+		Unions: []fidlgen.Union{{
+			Decl: fidlgen.Decl{Name: "foo/U"},
+			Members: []fidlgen.UnionMember{
+				{Ordinal: 64, Name: "a"},
+				{Ordinal: 65, Reserved: true},
+			},
+		}},
+	}
+	if err := CheckUniformPresence(r); err != nil {
+		t.Errorf("CheckUniformPresence() = %v, want nil", err)
+	}
+
+	r.Unions[0].Members = append(r.Unions[0].Members, fidlgen.UnionMember{Ordinal: 66, Name: "b"})
+	if err := CheckUniformPresence(r); err == nil {
+		t.Error("CheckUniformPresence() succeeded, want error")
+	}
+}